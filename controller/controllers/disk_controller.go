@@ -312,6 +312,8 @@ func mutateNbdServerService(svc *corev1.Service, diskName, _ string) {
 
 func mutateNbdServerDeployment(deploy *appsv1.Deployment, diskName, pvcName string) {
 	var replicas int32 = 1
+	// the server drains in flight I/O for up to 20s, leaving time to exit before SIGKILL
+	var termGracePeriod int64 = 30
 	deploy.Spec = appsv1.DeploymentSpec{
 		Replicas: &replicas,
 		Selector: &metav1.LabelSelector{
@@ -326,11 +328,13 @@ func mutateNbdServerDeployment(deploy *appsv1.Deployment, diskName, pvcName stri
 				},
 			},
 			Spec: corev1.PodSpec{
+				TerminationGracePeriodSeconds: &termGracePeriod,
 				Containers: []corev1.Container{
 					{
 						Name:            "disk",
 						Image:           "plockc/nbd-server:" + gitVersionLdFlag,
 						ImagePullPolicy: corev1.PullIfNotPresent,
+						Args:            []string{"-drain-timeout", "20s"},
 						Env:             []corev1.EnvVar{{Name: "REMOTE_STORAGE", Value: "replica-" + diskName + "-0.replica-sample:10808"}},
 						Ports: []corev1.ContainerPort{
 							{
@@ -0,0 +1,242 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// writeOption sends an option to the server during negotiation
+func writeOption(w io.Writer, opt option, data []byte) error {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], nbd_IHAVEOPT_MAGIC)
+	binary.BigEndian.PutUint32(header[8:12], uint32(opt))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to send option %d to server: %w", opt, err)
+	}
+	return nil
+}
+
+// readOptionReply reads the next reply from the server to an option
+func readOptionReply(r io.Reader, opt option) (optionReply, []byte, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("failed to read reply to option %d: %w", opt, err)
+	}
+	if binary.BigEndian.Uint64(header[0:8]) != nbd_OPT_REPLY_MAGIC {
+		return 0, nil, fmt.Errorf("missing option reply magic in reply to option %d", opt)
+	}
+	if replyOpt := option(binary.BigEndian.Uint32(header[8:12])); replyOpt != opt {
+		return 0, nil, fmt.Errorf("server replied to option %d while option %d was expected", replyOpt, opt)
+	}
+	replyType := optionReply(binary.BigEndian.Uint32(header[12:16]))
+	length := binary.BigEndian.Uint32(header[16:20])
+	if length > maxOptionLength {
+		return 0, nil, fmt.Errorf("reply to option %d has length %d over the limit of %d", opt, length, maxOptionLength)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, fmt.Errorf("failed to read data of reply to option %d: %w", opt, err)
+	}
+	return replyType, data, nil
+}
+
+// exportDetails are what the server tells the client about the export it selected
+type exportDetails struct {
+	size       uint64
+	flags      uint16
+	blockSizes store.BlockSizes
+}
+
+// clientNegotiate runs the client side of the fixed newstyle handshake and selects the
+// named export, starting TLS first if tlsConfig is set.  The returned connection, which is
+// the TLS session when TLS was started, is left in the transmission phase.
+func clientNegotiate(conn net.Conn, exportName string, tlsConfig *tls.Config) (net.Conn, exportDetails, error) {
+	conn, noZeroes, err := clientHandshake(conn, tlsConfig)
+	if err != nil {
+		return nil, exportDetails{}, err
+	}
+	details, err := clientGo(conn, exportName, noZeroes)
+	if err != nil {
+		return nil, exportDetails{}, err
+	}
+	return conn, details, nil
+}
+
+// clientHandshake reads the greeting and sends the client flags, starting TLS if
+// tlsConfig is set, leaving the connection ready for options
+func clientHandshake(conn net.Conn, tlsConfig *tls.Config) (net.Conn, bool, error) {
+	greeting := make([]byte, 18)
+	if n, err := io.ReadFull(conn, greeting); err != nil {
+		return nil, false, fmt.Errorf("Client Failed to read greeting during negotiation, read %d/18 bytes and error: %w", n, err)
+	}
+	if binary.BigEndian.Uint64([]byte("NBDMAGIC")) != binary.BigEndian.Uint64(greeting[0:8]) {
+		return nil, false, fmt.Errorf("missing NBDMAGIC from server greeting")
+	}
+	switch binary.BigEndian.Uint64(greeting[8:16]) {
+	case nbd_IHAVEOPT_MAGIC:
+	case nbd_CLISERV_MAGIC:
+		return nil, false, fmt.Errorf("server only supports the oldstyle handshake")
+	default:
+		return nil, false, fmt.Errorf("missing IHAVEOPT magic from server greeting")
+	}
+	serverFlags := binary.BigEndian.Uint16(greeting[16:18])
+	if serverFlags&nbd_FLAG_FIXED_NEWSTYLE == 0 {
+		return nil, false, fmt.Errorf("server does not support the fixed newstyle handshake")
+	}
+	clientFlags := nbd_FLAG_C_FIXED_NEWSTYLE
+	noZeroes := serverFlags&nbd_FLAG_NO_ZEROES != 0
+	if noZeroes {
+		clientFlags |= nbd_FLAG_C_NO_ZEROES
+	}
+	clientFlagBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(clientFlagBytes, clientFlags)
+	if _, err := conn.Write(clientFlagBytes); err != nil {
+		return nil, false, fmt.Errorf("failed to send client flags during negotiation: %w", err)
+	}
+
+	if tlsConfig != nil {
+		var err error
+		if conn, err = clientStartTLS(conn, tlsConfig); err != nil {
+			return nil, false, err
+		}
+	}
+	return conn, noZeroes, nil
+}
+
+// clientStartTLS upgrades the connection to TLS with nbd_OPT_STARTTLS
+func clientStartTLS(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	if err := writeOption(conn, nbd_OPT_STARTTLS, nil); err != nil {
+		return nil, err
+	}
+	replyType, data, err := readOptionReply(conn, nbd_OPT_STARTTLS)
+	if err != nil {
+		return nil, err
+	}
+	if replyType != nbd_REP_ACK {
+		return nil, fmt.Errorf("server refused to start TLS with error %#x: %s", uint32(replyType), data)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with server failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// clientStructuredReplies asks for structured replies, returning false if the server
+// does not support them
+func clientStructuredReplies(conn io.ReadWriter) (bool, error) {
+	if err := writeOption(conn, nbd_OPT_STRUCTURED_REPLY, nil); err != nil {
+		return false, err
+	}
+	replyType, _, err := readOptionReply(conn, nbd_OPT_STRUCTURED_REPLY)
+	if err != nil {
+		return false, err
+	}
+	return replyType == nbd_REP_ACK, nil
+}
+
+// clientSetMetaContext selects base:allocation on the export for block status, returning
+// the id of the context, or false if the server did not select it
+func clientSetMetaContext(conn io.ReadWriter, exportName string) (uint32, bool, error) {
+	data := make([]byte, 4+len(exportName)+8+len(baseAllocation))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(exportName)))
+	copy(data[4:], exportName)
+	queries := data[4+len(exportName):]
+	binary.BigEndian.PutUint32(queries[0:4], 1)
+	binary.BigEndian.PutUint32(queries[4:8], uint32(len(baseAllocation)))
+	copy(queries[8:], baseAllocation)
+	if err := writeOption(conn, nbd_OPT_SET_META_CONTEXT, data); err != nil {
+		return 0, false, err
+	}
+	var id uint32
+	selected := false
+	for {
+		replyType, data, err := readOptionReply(conn, nbd_OPT_SET_META_CONTEXT)
+		if err != nil {
+			return 0, false, err
+		}
+		switch {
+		case replyType == nbd_REP_META_CONTEXT:
+			if len(data) >= 4 && string(data[4:]) == baseAllocation {
+				id = binary.BigEndian.Uint32(data[0:4])
+				selected = true
+			}
+		case replyType == nbd_REP_ACK:
+			return id, selected, nil
+		case replyType&nbd_REP_FLAG_ERROR != 0:
+			return 0, false, nil
+		}
+	}
+}
+
+// clientGo selects the export with nbd_OPT_GO, falling back to nbd_OPT_EXPORT_NAME for
+// servers that do not support it
+func clientGo(conn io.ReadWriter, exportName string, noZeroes bool) (exportDetails, error) {
+	// ask for the block sizes so the device can be set up to suit the export
+	goData := make([]byte, 4+len(exportName)+4)
+	binary.BigEndian.PutUint32(goData[0:4], uint32(len(exportName)))
+	copy(goData[4:], exportName)
+	binary.BigEndian.PutUint16(goData[4+len(exportName):], 1)
+	binary.BigEndian.PutUint16(goData[6+len(exportName):], nbd_INFO_BLOCK_SIZE)
+	if err := writeOption(conn, nbd_OPT_GO, goData); err != nil {
+		return exportDetails{}, err
+	}
+	var details exportDetails
+	gotExportInfo := false
+	for {
+		replyType, data, err := readOptionReply(conn, nbd_OPT_GO)
+		if err != nil {
+			return exportDetails{}, err
+		}
+		switch {
+		case replyType == nbd_REP_INFO:
+			if len(data) >= 12 && binary.BigEndian.Uint16(data[0:2]) == nbd_INFO_EXPORT {
+				details.size = binary.BigEndian.Uint64(data[2:10])
+				details.flags = binary.BigEndian.Uint16(data[10:12])
+				gotExportInfo = true
+			}
+			if len(data) >= 14 && binary.BigEndian.Uint16(data[0:2]) == nbd_INFO_BLOCK_SIZE {
+				details.blockSizes = store.BlockSizes{
+					Minimum:   binary.BigEndian.Uint32(data[2:6]),
+					Preferred: binary.BigEndian.Uint32(data[6:10]),
+					Maximum:   binary.BigEndian.Uint32(data[10:14]),
+				}
+			}
+		case replyType == nbd_REP_ACK:
+			if !gotExportInfo {
+				return exportDetails{}, fmt.Errorf("server accepted export %q without sending its size", exportName)
+			}
+			return details, nil
+		case replyType == nbd_REP_ERR_UNSUP:
+			// servers without nbd_OPT_GO still support the original way to pick an export
+			return clientExportName(conn, exportName, noZeroes)
+		case replyType&nbd_REP_FLAG_ERROR != 0:
+			return exportDetails{}, fmt.Errorf("server refused export %q with error %#x: %s", exportName, uint32(replyType), data)
+		}
+	}
+}
+
+// clientExportName selects the export with nbd_OPT_EXPORT_NAME, which the server answers
+// with the export details instead of an option reply
+func clientExportName(conn io.ReadWriter, exportName string, noZeroes bool) (exportDetails, error) {
+	if err := writeOption(conn, nbd_OPT_EXPORT_NAME, []byte(exportName)); err != nil {
+		return exportDetails{}, err
+	}
+	details := make([]byte, 134)
+	if noZeroes {
+		details = details[:10]
+	}
+	if _, err := io.ReadFull(conn, details); err != nil {
+		return exportDetails{}, fmt.Errorf("failed to read details of export %q: %w", exportName, err)
+	}
+	return exportDetails{
+		size:  binary.BigEndian.Uint64(details[0:8]),
+		flags: binary.BigEndian.Uint16(details[8:10]),
+	}, nil
+}
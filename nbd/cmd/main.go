@@ -4,15 +4,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/plockc/disk8s/nbd"
+	"github.com/plockc/disk8s/nbd/internal/metrics"
 	"github.com/plockc/disk8s/nbd/internal/store"
 )
 
@@ -21,8 +25,13 @@ func usage() {
 		"Usage of " + os.Args[0] + ":",
 		"A Network Block Device (NBD).",
 		"Set environment variable REMOTE_STORAGE=host:port to connect via grpc.",
+		"Serve several named exports with REMOTE_STORAGE=name=host:port,name2=host2:port2.",
+		"Subcommands:",
+		"  list                   lists the nbd devices and what they are attached to",
+		"  attach <uri> [device]  attaches a device, a free one when not given, to the export at the NBD URI",
+		"  detach <device>        disconnects the device",
 	} {
-		fmt.Fprintf(flag.CommandLine.Output(), s)
+		fmt.Fprintln(flag.CommandLine.Output(), s)
 	}
 	flag.PrintDefaults()
 }
@@ -32,9 +41,30 @@ func main() {
 	go handleKill(killCtx)
 	defer cancelKill()
 
-	clientDevice := flag.String("client", "", "spawns an nbd client on given device path (e.g. /dev/nbd0) to connect to server over unix socket")
+	clientDevice := flag.String("client", "", "spawns an nbd client on given device path (e.g. /dev/nbd0) to connect to server over unix socket, "+
+		"or attaches -device to a server at an NBD URI like nbd://host:port/export, nbds://host/export or nbd+unix:///export?socket=path")
+	device := flag.String("device", "", "device path for a -client NBD URI, the kernel picks a free device when empty")
 	tcp := flag.Bool("tcp", false, "use tcp for client and server, if no client, tcp is automatic")
 	port := flag.Int("port", 10809, "port for TCP server on all interfaces")
+	socket := flag.String("socket", "", "also serve on a UNIX socket at this path, e.g. for qemu with nbd+unix://")
+	tlsCert := flag.String("tls-cert", "", "certificate file to offer TLS to clients")
+	tlsKey := flag.String("tls-key", "", "private key file for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file to verify client certificates, clients without one are refused")
+	tlsCA := flag.String("tls-ca", "", "client: CA file to verify the server and start TLS, with nbds:// the system roots are used without it")
+	tlsClientCert := flag.String("tls-client-cert", "", "client: certificate file presented to the server")
+	tlsClientKey := flag.String("tls-client-key", "", "client: private key file for -tls-client-cert")
+	tlsRequired := flag.Bool("tls-required", false, "refuse to serve clients that have not started TLS")
+	timeout := flag.Duration("timeout", 0, "client: fail a request the server has not answered in this time, 0 waits forever")
+	blockSize := flag.Uint("block-size", 0, "client: device block size, a power of two from 512 to the page size, by default picked from the export")
+	connections := flag.Int("connections", 1, "client: connections to the server the kernel spreads requests over, if the export allows it")
+	deadConnTimeout := flag.Duration("dead-conn-timeout", 0, "client: how long I/O stalls while reconnecting to the server, 0 is 2m")
+	maxSectorsKB := flag.Uint("max-sectors-kb", 0, "client: largest request sent to the server in KiB, at most the maximum block size of the export")
+	readAheadKB := flag.Uint("read-ahead-kb", 0, "client: read ahead of the device in KiB")
+	scheduler := flag.String("scheduler", "", "client: I/O scheduler of the device, e.g. none or mq-deadline")
+	drainTimeout := flag.Duration("drain-timeout", 20*time.Second, "on shutdown, how long requests in flight and cached writes have to reach storage")
+	maxConnections := flag.Int("max-connections", 64, "clients served at once, more wait until one disconnects")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on /metrics at this address, e.g. :9090")
+	readOnly := flag.Bool("read-only", false, "serve every export read-only, so it can be shared by many clients")
 	flag.Usage = usage
 
 	remote := os.Getenv("REMOTE_STORAGE")
@@ -43,20 +73,143 @@ func main() {
 
 	flag.Parse()
 
-	var storage store.Storage
-	if remote != "" {
+	// flags may also follow the subcommand
+	subcommand := flag.Arg(0)
+	if subcommand != "" {
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	switch subcommand {
+	case "":
+	case "list":
+		os.Exit(listDevices())
+	case "detach":
+		os.Exit(detachDevice(flag.Arg(0)))
+	case "attach":
+		if !strings.Contains(flag.Arg(0), "://") {
+			fmt.Println("attach needs an NBD URI like nbd://host/export")
+			os.Exit(2)
+		}
+		*clientDevice = flag.Arg(0)
+		if flag.Arg(1) != "" {
+			*device = flag.Arg(1)
+		}
+	default:
+		fmt.Println("unknown subcommand", subcommand)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	clientOpts := nbd.ClientOptions{
+		Timeout:         *timeout,
+		BlockSize:       uint32(*blockSize),
+		DeadConnTimeout: *deadConnTimeout,
+		Connections:     *connections,
+		DrainTimeout:    *drainTimeout,
+		Queue: nbd.QueueOptions{
+			MaxSectorsKB: uint32(*maxSectorsKB),
+			ReadAheadKB:  uint32(*readAheadKB),
+			Scheduler:    *scheduler,
+		},
+	}
+	if err := clientOpts.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *maxConnections < 1 {
+		fmt.Println("-max-connections must be at least 1")
+		os.Exit(2)
+	}
+
+	// a -client with a URI attaches to a remote server instead of one run here
+	var target *nbd.Target
+	if strings.Contains(*clientDevice, "://") {
+		t, err := nbd.ParseURI(*clientDevice)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		target = &t
+	}
+
+	// exports and the server TLS are only set up when a server runs here, attaching to a
+	// remote server needs neither
+	var exports *nbd.Exports
+	serverOpts := nbd.ServerOptions{TLSRequired: *tlsRequired, DrainTimeout: *drainTimeout, MaxConnections: *maxConnections}
+	if target == nil || *socket != "" {
+		exports = nbd.NewExports()
+		// released once every server using the exports has exited
+		defer exports.Release()
+		add := exports.Add
+		if *readOnly {
+			add = exports.AddReadOnly
+		}
+		if remote != "" {
+			for _, entry := range strings.Split(remote, ",") {
+				// entries without a name are served as the default export
+				name, hostPort := "", entry
+				if i := strings.Index(entry, "="); i >= 0 {
+					name, hostPort = entry[:i], entry[i+1:]
+				}
+				storage, err := store.NewRemote(hostPort)
+				if err != nil {
+					fmt.Println("Failed to Set up Remote Store:", err)
+					os.Exit(1)
+				}
+				if err := add(name, storage); err != nil {
+					fmt.Println("Failed to add export:", err)
+					os.Exit(1)
+				}
+			}
+		} else {
+			_ = add("", store.NewMemory())
+		}
+
+		if *tlsCert != "" {
+			var err error
+			serverOpts.TLS, err = nbd.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+			if err != nil {
+				fmt.Println("Failed to set up TLS:", err)
+				os.Exit(1)
+			}
+		} else if *tlsRequired || *tlsClientCA != "" {
+			fmt.Println("-tls-required and -tls-client-ca need -tls-cert and -tls-key")
+			os.Exit(1)
+		}
+	}
+
+	var clientTLS *tls.Config
+	if *tlsCA != "" || *tlsClientCert != "" {
+		// the scheme decides whether a remote server is asked for TLS, not the flags
+		if target != nil && !target.TLS {
+			fmt.Println("-tls-ca and -tls-client-cert need an nbds:// URI to start TLS")
+			os.Exit(2)
+		}
+		serverName := "localhost"
+		if target != nil {
+			serverName = target.Host()
+		}
 		var err error
-		storage, err = store.NewRemote(remote)
+		clientTLS, err = nbd.ClientTLSConfig(*tlsCA, *tlsClientCert, *tlsClientKey, serverName)
 		if err != nil {
-			fmt.Println("Failed to Set up Remote Store:", err)
+			fmt.Println("Failed to set up client TLS:", err)
 			os.Exit(1)
 		}
-	} else {
-		storage = store.NewMemory()
 	}
 
 	wg := sync.WaitGroup{}
 
+	// on shutdown the clients write back to the servers first, so servers are only told
+	// to drain once every client has disconnected
+	serverCtx, cancelServers := context.WithCancel(context.Background())
+	clients := sync.WaitGroup{}
+	client := func(f func() (string, error)) func() (string, error) {
+		clients.Add(1)
+		return func() (string, error) {
+			defer clients.Done()
+			return f()
+		}
+	}
+
 	routines := []func() (string, error){}
 
 	routines = append(routines, func() (string, error) {
@@ -66,39 +219,63 @@ func main() {
 
 	// always run a server
 	// check and register a start if we are running server in tcp mode
-	if *clientDevice == "" || *tcp {
+	if target == nil && (*clientDevice == "" || *tcp) {
 		routines = append(
 			routines,
 			func() (string, error) {
-				return "TCP Server", nbd.NewTCPSocketServer(ctx, storage, *port)
+				return "TCP Server", nbd.NewTCPSocketServer(serverCtx, exports, *port, serverOpts)
 			},
 		)
 	}
+	if *socket != "" {
+		routines = append(routines, func() (string, error) {
+			return "UNIX Socket Server", nbd.NewUnixSocketServer(serverCtx, exports, *socket, serverOpts)
+		})
+	}
 	// check if we are running a client
-	if *clientDevice != "" {
+	if target != nil {
+		routines = append(routines, client(func() (string, error) {
+			return "NBD Client", nbd.NewClient(ctx, *device, *target, clientTLS, clientOpts)
+		}))
+	} else if *clientDevice != "" {
 		// either we're running tcp client locally (server already registered to start)
 		// or need domain sockets on both client and server
 		if *tcp {
-			routines = append(routines, func() (string, error) {
+			routines = append(routines, client(func() (string, error) {
 				// give the server a moment to come up
 				time.Sleep(1 * time.Second)
-				return "TCP Client", nbd.NewTcpClient(ctx, *clientDevice, *port)
-			})
+				return "TCP Client", nbd.NewTcpClient(ctx, *clientDevice, *port, clientTLS, clientOpts)
+			}))
 		} else {
 			domainSockets := make(chan uintptr)
+			// the kernel does not negotiate over the domain socket, so it gets the default export
+			export, _ := exports.Get("")
 
 			routines = append(
 				routines,
+				client(func() (string, error) {
+					return "Domain Socket Client", nbd.NewDomainSocketClient(ctx, *clientDevice, export, domainSockets, clientOpts)
+				}),
 				func() (string, error) {
-					return "Domain Socket Client", nbd.NewDomainSocketClient(ctx, *clientDevice, domainSockets)
-				},
-				func() (string, error) {
-					return "Domain Socket Server", nbd.NewDomainSocketServer(ctx, storage, domainSockets)
+					return "Domain Socket Server", nbd.NewDomainSocketServer(serverCtx, export, domainSockets, serverOpts)
 				},
 			)
 		}
 	}
 
+	if *metricsAddr != "" {
+		// metrics stay up until the servers have drained
+		routines = append(routines, func() (string, error) {
+			return "Metrics", metrics.Serve(serverCtx, *metricsAddr)
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		clients.Wait()
+		cancelServers()
+	}()
+
 	for _, r := range routines {
 		f := r // get copy off the heap as r changes and we're spawning usage of r
 		wg.Add(1)
@@ -118,8 +295,45 @@ func main() {
 	wg.Wait()
 }
 
+func listDevices() int {
+	infos, err := nbd.ListDevices()
+	if err != nil {
+		fmt.Println("Failed to list devices:", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tPID\tSIZE\tBACKEND")
+	for _, info := range infos {
+		if !info.InUse() {
+			fmt.Fprintf(w, "%s\t-\t-\t-\n", info.Path())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%dMB\t%s\n", info.Path(), info.Pid, info.Size/1024/1024, info.Backend)
+	}
+	w.Flush()
+	return 0
+}
+
+func detachDevice(deviceName string) int {
+	if deviceName == "" {
+		fmt.Println("detach needs a device like /dev/nbd0")
+		return 2
+	}
+	device, err := nbd.ParseDevice(deviceName)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if err := device.Detach(); err != nil {
+		fmt.Println("Failed to detach:", err)
+		return 1
+	}
+	fmt.Println("detached", device.Path())
+	return 0
+}
+
 func handleSignal(ctx context.Context, cancel func()) {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	select {
 	case <-sigChan:
@@ -130,7 +344,7 @@ func handleSignal(ctx context.Context, cancel func()) {
 }
 
 func handleKill(ctx context.Context) {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Kill)
 	select {
 	case <-sigChan:
@@ -0,0 +1,542 @@
+package nbd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// Extent is a run of an export that is either allocated or a hole, as reported by
+// Conn.BlockStatus
+type Extent = store.Extent
+
+// DialOptions configure how Dial negotiates with the server
+type DialOptions struct {
+	// ExportName selects the export, the server picks its default export when empty
+	ExportName string
+	// TLS starts TLS with NBD_OPT_STARTTLS before selecting the export
+	TLS *tls.Config
+}
+
+// ServerError is the error the server replied with to a request
+type ServerError struct {
+	Errno   syscall.Errno
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("nbd server error: %v", e.Errno)
+	}
+	return fmt.Sprintf("nbd server error: %v: %s", e.Errno, e.Message)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Errno
+}
+
+var errConnClosed = errors.New("nbd connection is closed")
+
+// maxCommandLength splits trims, write zeroes and block status queries that do not fit
+// the 32 bit length of a request, it is aligned to any minimum block size
+const maxCommandLength = 1 << 31
+
+// Conn is a userspace connection to an export, requests from several goroutines are
+// pipelined on the connection and their replies matched up by handle
+type Conn struct {
+	conn    net.Conn
+	details exportDetails
+	// allocationID is the meta context for BlockStatus, if the server selected it
+	allocationID uint32
+	blockStatus  bool
+
+	// writeMu keeps requests from interleaving on the connection
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	nextHandle uint64
+	inFlight   map[uint64]*call
+	// err fails every request once the connection is done
+	err error
+
+	readerDone chan struct{}
+}
+
+// call is a request waiting on its reply, only the reader completes it
+type call struct {
+	command command
+	offset  uint64
+	// data receives what was read
+	data []byte
+	// covered are the ranges of data the chunks of a structured reply filled
+	covered [][2]uint64
+	extents []Extent
+	err     error
+	done    chan struct{}
+}
+
+// defaultDialTimeout bounds the negotiation when ctx has no deadline, so a server that
+// accepts but never answers does not hang the caller, tests shorten it
+var defaultDialTimeout = 30 * time.Second
+
+// Dial connects to the server and selects the export, the deadline of ctx, or 30s without
+// one, bounds the negotiation
+func Dial(ctx context.Context, network, address string, opts DialOptions) (*Conn, error) {
+	dialer := net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultDialTimeout)
+	}
+	_ = netConn.SetDeadline(deadline)
+	c, err := negotiateConn(netConn, opts)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	go c.readReplies()
+	return c, nil
+}
+
+// DialURI connects to the export of an NBD URI, opts.TLS is used for the nbds schemes
+func DialURI(ctx context.Context, uri string, opts DialOptions) (*Conn, error) {
+	target, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	opts.ExportName = target.ExportName
+	opts.TLS = targetTLSConfig(target, opts.TLS)
+	return Dial(ctx, target.Network, target.Address, opts)
+}
+
+// negotiateConn asks for structured replies and base:allocation so block status is
+// available, then selects the export
+func negotiateConn(netConn net.Conn, opts DialOptions) (*Conn, error) {
+	conn, noZeroes, err := clientHandshake(netConn, opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:       conn,
+		inFlight:   map[uint64]*call{},
+		readerDone: make(chan struct{}),
+	}
+	structured, err := clientStructuredReplies(conn)
+	if err != nil {
+		return nil, err
+	}
+	if structured {
+		if c.allocationID, c.blockStatus, err = clientSetMetaContext(conn, opts.ExportName); err != nil {
+			return nil, err
+		}
+	}
+	if c.details, err = clientGo(conn, opts.ExportName, noZeroes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Size of the export in bytes
+func (c *Conn) Size() uint64 {
+	return c.details.size
+}
+
+// ReadOnly is true if the server refuses writes to the export
+func (c *Conn) ReadOnly() bool {
+	return c.details.flags&nbd_FLAG_READ_ONLY != 0
+}
+
+// maxRequest is the most data sent or read in one request
+func (c *Conn) maxRequest() int {
+	if maximum := c.details.blockSizes.Maximum; maximum != 0 && maximum < maxPayload {
+		return int(maximum)
+	}
+	return maxPayload
+}
+
+// ReadAt fills p from the export at the offset
+func (c *Conn) ReadAt(ctx context.Context, p []byte, off uint64) error {
+	for start := 0; start < len(p); {
+		end := start + c.maxRequest()
+		if end > len(p) {
+			end = len(p)
+		}
+		call, err := c.do(ctx, nbd_CMD_READ, 0, off+uint64(start), uint32(end-start), nil)
+		if err != nil {
+			return err
+		}
+		copy(p[start:end], call.data)
+		start = end
+	}
+	return nil
+}
+
+// WriteAt writes p to the export at the offset, and when fua is set the data is durable
+// before returning
+func (c *Conn) WriteAt(ctx context.Context, p []byte, off uint64, fua bool) error {
+	var flags commandFlags
+	if fua && c.details.flags&nbd_FLAG_SEND_FUA != 0 {
+		flags = nbd_CMD_FLAG_FUA
+	}
+	for start := 0; start < len(p); {
+		end := start + c.maxRequest()
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := c.do(ctx, nbd_CMD_WRITE, flags, off+uint64(start), uint32(end-start), p[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	if fua && flags == 0 {
+		// the server cannot make a single write durable, so make them all durable
+		return c.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush makes all completed writes durable, servers that do not advertise flush have
+// nothing to flush
+func (c *Conn) Flush(ctx context.Context) error {
+	if c.details.flags&nbd_FLAG_SEND_FLUSH == 0 {
+		return nil
+	}
+	_, err := c.do(ctx, nbd_CMD_FLUSH, 0, 0, 0, nil)
+	return err
+}
+
+// Trim discards the data in the range, it is only a hint so servers that do not
+// advertise trim ignore it
+func (c *Conn) Trim(ctx context.Context, off, length uint64) error {
+	if c.details.flags&nbd_FLAG_SEND_TRIM == 0 {
+		return nil
+	}
+	return c.eachCommand(off, length, func(off uint64, length uint32) error {
+		_, err := c.do(ctx, nbd_CMD_TRIM, 0, off, length, nil)
+		return err
+	})
+}
+
+// WriteZeroes writes zeroes to the range, possibly as a hole unless noHole is set, and
+// writes the zeroes out itself if the server does not advertise write zeroes
+func (c *Conn) WriteZeroes(ctx context.Context, off, length uint64, noHole bool) error {
+	if c.details.flags&nbd_FLAG_SEND_WRITE_ZEROES == 0 {
+		zeroes := make([]byte, c.maxRequest())
+		for length > 0 {
+			n := uint64(len(zeroes))
+			if length < n {
+				n = length
+			}
+			if err := c.WriteAt(ctx, zeroes[:n], off, false); err != nil {
+				return err
+			}
+			off += n
+			length -= n
+		}
+		return nil
+	}
+	var flags commandFlags
+	if noHole {
+		flags = nbd_CMD_FLAG_NO_HOLE
+	}
+	return c.eachCommand(off, length, func(off uint64, length uint32) error {
+		_, err := c.do(ctx, nbd_CMD_WRITE_ZEROES, flags, off, length, nil)
+		return err
+	})
+}
+
+// BlockStatus describes which parts of the range are allocated, the extents cover the
+// range unless the server stops short of it
+func (c *Conn) BlockStatus(ctx context.Context, off, length uint64) ([]Extent, error) {
+	if !c.blockStatus {
+		return nil, fmt.Errorf("server did not select the %s meta context for block status", baseAllocation)
+	}
+	var extents []Extent
+	for length > 0 {
+		n := uint64(maxCommandLength)
+		if length < n {
+			n = length
+		}
+		call, err := c.do(ctx, nbd_CMD_BLOCK_STATUS, 0, off, uint32(n), nil)
+		if err != nil {
+			return nil, err
+		}
+		// the last extent may run past the range, it is clipped like the server does
+		described := trimExtents(call.extents, length, false)
+		extents = append(extents, described...)
+		covered := uint64(0)
+		for _, extent := range described {
+			covered += extent.Length
+		}
+		if covered == 0 {
+			break
+		}
+		off += covered
+		length -= covered
+	}
+	return extents, nil
+}
+
+// Close disconnects from the server, requests still in flight fail
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = errConnClosed
+	}
+	c.mu.Unlock()
+
+	// the server does not reply to a disconnect, so it is sent on a best effort basis
+	c.writeMu.Lock()
+	_, _ = c.conn.Write(clientRequest(nbd_CMD_DISC, 0, 0, 0, 0))
+	c.writeMu.Unlock()
+	err := c.conn.Close()
+	<-c.readerDone
+	return err
+}
+
+// eachCommand splits a range into lengths that fit a request
+func (c *Conn) eachCommand(off, length uint64, f func(off uint64, length uint32) error) error {
+	for length > 0 {
+		n := uint64(maxCommandLength)
+		if length < n {
+			n = length
+		}
+		if err := f(off, uint32(n)); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+func clientRequest(cmd command, flags commandFlags, handle, offset uint64, length uint32) []byte {
+	req := make([]byte, requestSize)
+	binary.BigEndian.PutUint32(req[0:4], nbd_REQUEST_MAGIC)
+	binary.BigEndian.PutUint16(req[4:6], uint16(flags))
+	binary.BigEndian.PutUint16(req[6:8], uint16(cmd))
+	binary.BigEndian.PutUint64(req[8:16], handle)
+	binary.BigEndian.PutUint64(req[16:24], offset)
+	binary.BigEndian.PutUint32(req[24:28], length)
+	return req
+}
+
+// do sends a request and waits for its reply, if ctx is done first the reply is
+// dropped when it arrives
+func (c *Conn) do(ctx context.Context, cmd command, flags commandFlags, offset uint64, length uint32, payload []byte) (*call, error) {
+	cl := &call{command: cmd, offset: offset, done: make(chan struct{})}
+	if cmd == nbd_CMD_READ {
+		// read into a buffer of our own, the caller's may be reused if it gives up
+		cl.data = make([]byte, length)
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextHandle++
+	handle := c.nextHandle
+	c.inFlight[handle] = cl
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	_, err := c.conn.Write(clientRequest(cmd, flags, handle, offset, length))
+	if err == nil && len(payload) > 0 {
+		_, err = c.conn.Write(payload)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		// a partial request leaves the connection unusable, closing it has the reader
+		// fail everything in flight
+		c.conn.Close()
+	}
+
+	select {
+	case <-cl.done:
+		return cl, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readReplies completes calls as their replies arrive, and fails the rest once the
+// connection is done
+func (c *Conn) readReplies() {
+	defer close(c.readerDone)
+	var err error
+	for err == nil {
+		err = c.readReply()
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = fmt.Errorf("nbd connection failed: %w", err)
+	}
+	calls := c.inFlight
+	c.inFlight = map[uint64]*call{}
+	c.mu.Unlock()
+	c.conn.Close()
+	for _, cl := range calls {
+		cl.err = c.err
+		close(cl.done)
+	}
+}
+
+// lookup finds the call for a reply, removing it when it is the last reply
+func (c *Conn) lookup(handle uint64, done bool) (*call, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.inFlight[handle]
+	if !ok {
+		return nil, fmt.Errorf("server replied to unknown handle %d", handle)
+	}
+	if done {
+		delete(c.inFlight, handle)
+	}
+	return cl, nil
+}
+
+func (c *Conn) readReply() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return err
+	}
+	switch binary.BigEndian.Uint32(header[0:4]) {
+	case nbd_REPLY_MAGIC:
+		cl, err := c.lookup(binary.BigEndian.Uint64(header[8:16]), true)
+		if err != nil {
+			return err
+		}
+		if errno := binary.BigEndian.Uint32(header[4:8]); errno != 0 {
+			cl.err = &ServerError{Errno: syscall.Errno(errno)}
+		} else if cl.command == nbd_CMD_READ {
+			if _, err := io.ReadFull(c.conn, cl.data); err != nil {
+				return err
+			}
+		}
+		close(cl.done)
+		return nil
+	case nbd_STRUCTURED_REPLY_MAGIC:
+		header = append(header, make([]byte, 4)...)
+		if _, err := io.ReadFull(c.conn, header[16:20]); err != nil {
+			return err
+		}
+		flags := binary.BigEndian.Uint16(header[4:6])
+		typ := chunkType(binary.BigEndian.Uint16(header[6:8]))
+		length := binary.BigEndian.Uint32(header[16:20])
+		if length > maxPayload+8 {
+			return fmt.Errorf("reply chunk of %d bytes is over the limit of %d", length, maxPayload+8)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return err
+		}
+		done := flags&nbd_REPLY_FLAG_DONE != 0
+		cl, err := c.lookup(binary.BigEndian.Uint64(header[8:16]), done)
+		if err != nil {
+			return err
+		}
+		if err := c.chunk(cl, typ, payload); err != nil {
+			return err
+		}
+		if done {
+			cl.checkCovered()
+			close(cl.done)
+		}
+		return nil
+	}
+	return fmt.Errorf("reply from server has wrong magic %#x", header[0:4])
+}
+
+// checkCovered fails a read whose chunks left part of it unread, unless it already failed
+func (cl *call) checkCovered() {
+	if cl.command != nbd_CMD_READ || cl.err != nil {
+		return
+	}
+	total := uint64(0)
+	for _, r := range cl.covered {
+		total += r[1] - r[0]
+	}
+	// overlaps have already failed the read, so the chunks cover it when they add up
+	if total != uint64(len(cl.data)) {
+		cl.err = fmt.Errorf("read reply covered %d of %d bytes at %d", total, len(cl.data), cl.offset)
+	}
+}
+
+// chunk applies a chunk of a structured reply to its call
+func (c *Conn) chunk(cl *call, typ chunkType, payload []byte) error {
+	switch {
+	case typ == nbd_REPLY_TYPE_NONE:
+	case typ == nbd_REPLY_TYPE_OFFSET_DATA || typ == nbd_REPLY_TYPE_OFFSET_HOLE:
+		if cl.command != nbd_CMD_READ || len(payload) < 8 {
+			return fmt.Errorf("unexpected read chunk for command %d", cl.command)
+		}
+		start := binary.BigEndian.Uint64(payload[0:8]) - cl.offset
+		data := payload[8:]
+		length := uint64(len(data))
+		if typ == nbd_REPLY_TYPE_OFFSET_HOLE {
+			if len(payload) != 12 {
+				return fmt.Errorf("hole chunk has %d bytes", len(payload))
+			}
+			length = uint64(binary.BigEndian.Uint32(payload[8:12]))
+		}
+		if start > uint64(len(cl.data)) || length > uint64(len(cl.data))-start {
+			return fmt.Errorf("read chunk of %d bytes at %d is outside of the request", length, start)
+		}
+		for _, r := range cl.covered {
+			if start < r[1] && r[0] < start+length && cl.err == nil {
+				cl.err = fmt.Errorf("read chunk of %d bytes at %d overlaps another chunk", length, cl.offset+start)
+			}
+		}
+		cl.covered = append(cl.covered, [2]uint64{start, start + length})
+		if typ == nbd_REPLY_TYPE_OFFSET_HOLE {
+			for i := range cl.data[start : start+length] {
+				cl.data[start+uint64(i)] = 0
+			}
+		} else {
+			copy(cl.data[start:], data)
+		}
+	case typ == nbd_REPLY_TYPE_BLOCK_STATUS:
+		if cl.command != nbd_CMD_BLOCK_STATUS || len(payload) < 4 || (len(payload)-4)%8 != 0 {
+			return fmt.Errorf("unexpected block status chunk for command %d", cl.command)
+		}
+		if binary.BigEndian.Uint32(payload[0:4]) != c.allocationID {
+			// only base:allocation was selected, so there is nothing else to report on
+			return nil
+		}
+		for i := 4; i < len(payload); i += 8 {
+			cl.extents = append(cl.extents, Extent{
+				Length: uint64(binary.BigEndian.Uint32(payload[i : i+4])),
+				Hole:   binary.BigEndian.Uint32(payload[i+4:i+8])&nbd_STATE_HOLE != 0,
+			})
+		}
+	case typ&(1<<15) != 0:
+		// every error chunk starts with the error and a message
+		if len(payload) < 6 {
+			return fmt.Errorf("error chunk has %d bytes", len(payload))
+		}
+		messageLen := int(binary.BigEndian.Uint16(payload[4:6]))
+		if 6+messageLen > len(payload) {
+			return fmt.Errorf("error message of %d bytes overruns the chunk", messageLen)
+		}
+		if cl.err == nil {
+			cl.err = &ServerError{
+				Errno:   syscall.Errno(binary.BigEndian.Uint32(payload[0:4])),
+				Message: string(payload[6 : 6+messageLen]),
+			}
+		}
+	}
+	return nil
+}
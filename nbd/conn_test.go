@@ -0,0 +1,323 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// failingStorage fails every read and write with err
+type failingStorage struct {
+	*fuzzStorage
+	err error
+}
+
+func (s *failingStorage) ReadAt(context.Context, []byte, uint64) error { return s.err }
+
+func (s *failingStorage) WriteAt(context.Context, []byte, uint64, bool) error { return s.err }
+
+// dialTest serves the storage as the export "disk" on a loopback listener and connects to it
+func dialTest(t *testing.T, storage store.Storage, readOnly bool) *Conn {
+	t.Helper()
+	exports := NewExports()
+	add := exports.Add
+	if readOnly {
+		add = exports.AddReadOnly
+	}
+	if err := add("disk", storage); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(exports.Release)
+	addr := testServer(t, exports, ServerOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "tcp", addr, DialOptions{ExportName: "disk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnReadWrite(t *testing.T) {
+	ctx := context.Background()
+	c := dialTest(t, store.NewMemory(), false)
+	if c.ReadOnly() {
+		t.Fatal("export is read-only")
+	}
+
+	data := make([]byte, 3<<20+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := c.WriteAt(ctx, data, 1000, true); err != nil {
+		t.Fatal(err)
+	}
+	// several goroutines share the connection, their requests are pipelined
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			errs <- c.WriteAt(ctx, []byte{byte(i + 1)}, uint64(i)*4096, false)
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	if err := c.ReadAt(ctx, got, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		// the small writes landed on top of the large one
+		if pos := i*4096 - 1000; pos >= 0 {
+			data[pos] = byte(i + 1)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read back different data than was written")
+	}
+	first := make([]byte, 1)
+	if err := c.ReadAt(ctx, first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if first[0] != 1 {
+		t.Fatalf("read %d at 0, expected 1", first[0])
+	}
+}
+
+func TestConnReadPastEnd(t *testing.T) {
+	ctx := context.Background()
+	c := dialTest(t, store.NewMemory(), false)
+	size := c.Size()
+
+	tests := []struct {
+		off    uint64
+		length int
+	}{
+		{size - 1, 2},
+		{size, 1},
+		{size + 4096, 512},
+		{1<<64 - 512, 1024},
+	}
+	for _, test := range tests {
+		err := c.ReadAt(ctx, make([]byte, test.length), test.off)
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.Errno != syscall.EINVAL {
+			t.Errorf("read of %d bytes at %d got %v, expected EINVAL", test.length, test.off, err)
+		}
+	}
+	// the connection is still usable after the errors
+	last := make([]byte, 1)
+	if err := c.ReadAt(ctx, last, size-1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnTrimWriteZeroes(t *testing.T) {
+	ctx := context.Background()
+	c := dialTest(t, store.NewMemory(), false)
+
+	data := bytes.Repeat([]byte{0xff}, 4*4096)
+	if err := c.WriteAt(ctx, data, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteZeroes(ctx, 4096, 4096, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Trim(ctx, 8192, 4096); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if err := c.ReadAt(ctx, got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		zeroed := i >= 4096 && i < 3*4096
+		if zeroed != (b == 0) {
+			t.Fatalf("byte %d is %#x after write zeroes and trim", i, b)
+		}
+	}
+
+	extents, err := c.BlockStatus(ctx, 0, uint64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writing zeroes without a hole keeps the block allocated, the trimmed one is a hole
+	want := []Extent{{Length: 8192}, {Length: 4096, Hole: true}, {Length: 4096}}
+	if fmt.Sprint(extents) != fmt.Sprint(want) {
+		t.Fatalf("extents %v, expected %v", extents, want)
+	}
+}
+
+func TestConnBlockStatus(t *testing.T) {
+	ctx := context.Background()
+	c := dialTest(t, store.NewMemory(), false)
+
+	if err := c.WriteAt(ctx, make([]byte, 4096), 8192, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		off, length uint64
+		want        []Extent
+	}{
+		{0, 32768, []Extent{{Length: 8192, Hole: true}, {Length: 4096}, {Length: 20480, Hole: true}}},
+		{8192, 4096, []Extent{{Length: 4096}}},
+		{10000, 100, []Extent{{Length: 100}}},
+		{12288, 512, []Extent{{Length: 512, Hole: true}}},
+	}
+	for _, test := range tests {
+		extents, err := c.BlockStatus(ctx, test.off, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(extents) != fmt.Sprint(test.want) {
+			t.Errorf("extents of %d bytes at %d are %v, expected %v", test.length, test.off, extents, test.want)
+		}
+	}
+
+	_, err := c.BlockStatus(ctx, c.Size(), 4096)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("block status past the end got %v, expected EINVAL", err)
+	}
+}
+
+func TestConnErrors(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		storage  store.Storage
+		readOnly bool
+		want     syscall.Errno
+	}{
+		{"timeout", &failingStorage{&fuzzStorage{data: make([]byte, fuzzSize)}, store.ErrTimeout}, false, syscall.ETIMEDOUT},
+		{"no space", &failingStorage{&fuzzStorage{data: make([]byte, fuzzSize)}, store.ErrNoSpace}, false, syscall.ENOSPC},
+		{"i/o", &failingStorage{&fuzzStorage{data: make([]byte, fuzzSize)}, errors.New("disk on fire")}, false, syscall.EIO},
+		{"read-only", &fuzzStorage{data: make([]byte, fuzzSize)}, true, syscall.EPERM},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialTest(t, test.storage, test.readOnly)
+			err := c.WriteAt(ctx, []byte("data"), 0, false)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("write got %v, expected %v", err, test.want)
+			}
+			var serverErr *ServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("write got %T, expected a ServerError", err)
+			}
+		})
+	}
+}
+
+// chunk is a read chunk sent by a fake server, data when hole is not set
+type chunk struct {
+	off, length uint64
+	hole        bool
+}
+
+func TestConnReadCoverage(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []chunk
+		ok     bool
+	}{
+		{"exact", []chunk{{4096, 4096, true}, {0, 4096, false}}, true},
+		{"gap", []chunk{{0, 4096, false}, {6144, 2048, true}}, false},
+		{"overlap", []chunk{{0, 4096, false}, {2048, 6144, true}}, false},
+		{"repeated", []chunk{{0, 8192, false}, {0, 8192, false}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			c := &Conn{conn: client, inFlight: map[uint64]*call{}, readerDone: make(chan struct{})}
+			go c.readReplies()
+			defer c.Close()
+
+			// the fake server answers the one read with the chunks of the test
+			go func() {
+				req := request(make([]byte, requestSize))
+				if _, err := io.ReadFull(server, req); err != nil {
+					return
+				}
+				ss := &serviceSocket{structuredReplies: true}
+				for i, ch := range test.chunks {
+					var flags uint16
+					if i == len(test.chunks)-1 {
+						flags = nbd_REPLY_FLAG_DONE
+					}
+					payload := make([]byte, 8)
+					binary.BigEndian.PutUint64(payload, ch.off)
+					typ := chunkType(nbd_REPLY_TYPE_OFFSET_DATA)
+					if ch.hole {
+						typ = nbd_REPLY_TYPE_OFFSET_HOLE
+						payload = append(payload, 0, 0, 0, 0)
+						binary.BigEndian.PutUint32(payload[8:12], uint32(ch.length))
+					} else {
+						payload = append(payload, bytes.Repeat([]byte{1}, int(ch.length))...)
+					}
+					_, _ = server.Write(append(ss.chunkHeader(req, flags, typ, uint64(len(payload))), payload...))
+				}
+				// keep reading so the disconnect does not block
+				_, _ = io.Copy(io.Discard, server)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := c.ReadAt(ctx, make([]byte, 8192), 0)
+			if test.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("read succeeded without its chunks covering it exactly once")
+			}
+		})
+	}
+}
+
+func TestDialDefaultDeadline(t *testing.T) {
+	// the server accepts the connection but never sends its greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	defaultDialTimeout = 100 * time.Millisecond
+	defer func() { defaultDialTimeout = 30 * time.Second }()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Dial(context.Background(), "tcp", listener.Addr().String(), DialOptions{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("dial succeeded without a greeting")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("dial without a deadline hung on a silent server")
+	}
+}
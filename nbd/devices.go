@@ -0,0 +1,140 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysBlock has the sysfs attributes of the block devices, like /sys/block/nbd0/pid
+const sysBlock = "/sys/block"
+
+// DeviceInfo is what sysfs tells about a device
+type DeviceInfo struct {
+	Device
+	// Pid is the process that connected the device, 0 when the device is free
+	Pid int
+	// Size in bytes
+	Size uint64
+	// Backend is the export the device is attached to, when it was connected over netlink
+	Backend string
+}
+
+func (i DeviceInfo) InUse() bool {
+	return i.Pid != 0
+}
+
+// ParseDevice is the device of a path like /dev/nbd0
+func ParseDevice(deviceName string) (Device, error) {
+	index, err := deviceIndex(deviceName)
+	if err != nil {
+		return Device{}, err
+	}
+	if index < 0 {
+		return Device{}, errors.New("no nbd device given")
+	}
+	return Device{Index: uint32(index)}, nil
+}
+
+// ListDevices finds the nbd devices in /dev and reads their state from sysfs
+func ListDevices() ([]DeviceInfo, error) {
+	paths, err := filepath.Glob("/dev/nbd*")
+	if err != nil {
+		return nil, err
+	}
+	infos := []DeviceInfo{}
+	for _, path := range paths {
+		// partitions like /dev/nbd0p1 are not devices to attach
+		index, err := deviceIndex(path)
+		if err != nil {
+			continue
+		}
+		info, err := Device{Index: uint32(index)}.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Index < infos[j].Index })
+	return infos, nil
+}
+
+// Info reads the state of the device from sysfs, the pid and backend only exist
+// while the device is connected
+func (d Device) Info() (DeviceInfo, error) {
+	info := DeviceInfo{Device: d}
+	dir := filepath.Join(sysBlock, fmt.Sprintf("nbd%d", d.Index))
+
+	sectors, err := readSysfs(dir, "size")
+	if err != nil {
+		return info, err
+	}
+	if sectors != "" {
+		// the size is always in 512 byte sectors, whatever the block size
+		n, err := strconv.ParseUint(sectors, 10, 64)
+		if err != nil {
+			return info, fmt.Errorf("invalid size of %s: %w", d.Path(), err)
+		}
+		info.Size = n * 512
+	}
+	pid, err := readSysfs(dir, "pid")
+	if err != nil {
+		return info, err
+	}
+	if pid != "" {
+		if info.Pid, err = strconv.Atoi(pid); err != nil {
+			return info, fmt.Errorf("invalid pid of %s: %w", d.Path(), err)
+		}
+	}
+	info.Backend, err = readSysfs(dir, "backend")
+	return info, err
+}
+
+// readSysfs reads one attribute, a missing one is empty
+func readSysfs(dir, attr string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, attr))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// FreeDevice picks the device with the lowest index that is not in use
+func FreeDevice() (Device, error) {
+	infos, err := ListDevices()
+	if err != nil {
+		return Device{}, err
+	}
+	for _, info := range infos {
+		if !info.InUse() {
+			return info.Device, nil
+		}
+	}
+	return Device{}, errors.New("no free nbd device, is the 'nbd' kernel module loaded?")
+}
+
+// Detach disconnects the device whether it was connected over netlink or with ioctls
+func (d Device) Detach() error {
+	err := d.Disconnect()
+	if !errors.Is(err, errNoNetlink) {
+		return err
+	}
+	f, err := os.OpenFile(d.Path(), os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", d.Path(), err)
+	}
+	defer f.Close()
+	fd := descriptor(f.Fd())
+	if err := fd.ioctl(nbd_DISCONNECT, 0); err != nil {
+		return err
+	}
+	_ = fd.ioctl(nbd_CLEAR_SOCK, 0)
+	return nil
+}
@@ -0,0 +1,85 @@
+package nbd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// Export is a named Storage that clients select during negotiation
+type Export struct {
+	Name    string
+	Storage store.Storage
+	// ReadOnly exports refuse writes even if the storage could take them
+	ReadOnly bool
+}
+
+// Exports is the registry of named exports a server offers to its clients.
+// Clients asking for the empty (default) name get the export named "" if there
+// is one, otherwise the first export added.
+type Exports struct {
+	mu      sync.RWMutex
+	exports map[string]*Export
+	// names keeps the order exports were added for listing
+	names []string
+}
+
+func NewExports() *Exports {
+	return &Exports{exports: map[string]*Export{}}
+}
+
+// Add registers storage to be served under name
+func (e *Exports) Add(name string, storage store.Storage) error {
+	return e.add(&Export{Name: name, Storage: storage})
+}
+
+// AddReadOnly registers storage to be served under name without allowing writes, so
+// it can be shared by many clients
+func (e *Exports) AddReadOnly(name string, storage store.Storage) error {
+	return e.add(&Export{Name: name, Storage: storage, ReadOnly: true})
+}
+
+func (e *Exports) add(export *Export) error {
+	name := export.Name
+	if len(name) > 4096 {
+		return fmt.Errorf("export name is %d bytes, over the limit of 4096", len(name))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.exports[name]; ok {
+		return fmt.Errorf("export %q is already registered", name)
+	}
+	e.exports[name] = export
+	e.names = append(e.names, name)
+	return nil
+}
+
+// Get looks up the export a client asked for by name
+func (e *Exports) Get(name string) (*Export, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if export, ok := e.exports[name]; ok {
+		return export, true
+	}
+	if name == "" && len(e.names) > 0 {
+		return e.exports[e.names[0]], true
+	}
+	return nil, false
+}
+
+// Names lists the export names in the order they were added
+func (e *Exports) Names() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]string{}, e.names...)
+}
+
+// Release releases the Storage behind every export
+func (e *Exports) Release() {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, name := range e.names {
+		e.exports[name].Storage.Release()
+	}
+}
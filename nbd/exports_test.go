@@ -0,0 +1,101 @@
+package nbd
+
+import (
+	"strings"
+	"testing"
+)
+
+// releaseCounter counts how often it is released
+type releaseCounter struct {
+	*fuzzStorage
+	released int
+}
+
+func (s *releaseCounter) Release() { s.released++ }
+
+func TestExportsGet(t *testing.T) {
+	tests := []struct {
+		name   string
+		added  []string
+		get    string
+		want   string
+		wantOk bool
+	}{
+		{"named", []string{"a", "b"}, "b", "b", true},
+		{"unknown", []string{"a", "b"}, "c", "", false},
+		{"default is the empty name", []string{"a", "", "b"}, "", "", true},
+		{"missing default is the first added", []string{"b", "a"}, "", "b", true},
+		{"no exports", nil, "", "", false},
+		{"names are case sensitive", []string{"disk"}, "Disk", "", false},
+	}
+	for _, test := range tests {
+		exports := NewExports()
+		for _, name := range test.added {
+			if err := exports.Add(name, &fuzzStorage{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		export, ok := exports.Get(test.get)
+		if ok != test.wantOk || (ok && export.Name != test.want) {
+			t.Errorf("%s: Get(%q) = %v, %v", test.name, test.get, export, ok)
+		}
+	}
+}
+
+func TestExportsAdd(t *testing.T) {
+	exports := NewExports()
+	tests := []struct {
+		name     string
+		readOnly bool
+		wantErr  bool
+	}{
+		{"a", false, false},
+		{"", true, false},
+		{"a", false, true},
+		{"a", true, true},
+		{"", false, true},
+		{strings.Repeat("x", 4096), false, false},
+		{strings.Repeat("x", 4097), false, true},
+	}
+	for _, test := range tests {
+		add := exports.Add
+		if test.readOnly {
+			add = exports.AddReadOnly
+		}
+		if err := add(test.name, &fuzzStorage{}); (err != nil) != test.wantErr {
+			t.Errorf("adding %.10q got %v", test.name, err)
+		}
+	}
+	if names := exports.Names(); len(names) != 3 || names[0] != "a" || names[1] != "" {
+		t.Fatalf("names %.10q", names)
+	}
+	// a duplicate leaves the first export in place
+	if export, _ := exports.Get("a"); export.ReadOnly {
+		t.Fatal("duplicate replaced the export")
+	}
+	if export, _ := exports.Get(""); !export.ReadOnly {
+		t.Fatal("read-only export is writable")
+	}
+}
+
+func TestExportsRelease(t *testing.T) {
+	exports := NewExports()
+	storages := []*releaseCounter{{}, {}}
+	for i, storage := range storages {
+		if err := exports.Add(string(rune('a'+i)), storage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a storage refused as a duplicate belongs to the caller
+	duplicate := &releaseCounter{}
+	_ = exports.Add("a", duplicate)
+	exports.Release()
+	for i, storage := range storages {
+		if storage.released != 1 {
+			t.Errorf("storage %d released %d times", i, storage.released)
+		}
+	}
+	if duplicate.released != 0 {
+		t.Errorf("duplicate released %d times", duplicate.released)
+	}
+}
@@ -0,0 +1,172 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// fuzzSize keeps the export small so the fuzzer reaches its end quickly
+const fuzzSize = 64 * 1024
+
+// fuzzStorage is a small in memory disk that reports every extent as data
+type fuzzStorage struct {
+	data []byte
+}
+
+func (s *fuzzStorage) ReadAt(_ context.Context, p []byte, off uint64) error {
+	copy(p, s.data[off:])
+	return nil
+}
+
+func (s *fuzzStorage) WriteAt(_ context.Context, p []byte, off uint64, _ bool) error {
+	copy(s.data[off:], p)
+	return nil
+}
+
+func (s *fuzzStorage) Flush(context.Context) error { return nil }
+
+func (s *fuzzStorage) Trim(context.Context, uint64, uint64) error { return nil }
+
+func (s *fuzzStorage) WriteZeroes(_ context.Context, off, length uint64, _ bool) error {
+	copy(s.data[off:off+length], make([]byte, length))
+	return nil
+}
+
+func (s *fuzzStorage) Extents(_ context.Context, _, length uint64) ([]store.Extent, error) {
+	return []store.Extent{{Length: length}}, nil
+}
+
+func (s *fuzzStorage) Size(context.Context) (uint64, error) { return uint64(len(s.data)), nil }
+
+func (s *fuzzStorage) Capabilities() store.Capabilities {
+	return store.Capabilities{
+		Flush: true, FUA: true, Trim: true, WriteZeroes: true,
+		BlockSizes: store.BlockSizes{Minimum: 1, Preferred: 4096, Maximum: maxPayload},
+	}
+}
+
+func (s *fuzzStorage) Release() {}
+
+func extendedRequest(cmd command, flags commandFlags, handle, off, length uint64) []byte {
+	r := make([]byte, 32)
+	binary.BigEndian.PutUint32(r[0:4], nbd_EXTENDED_REQUEST_MAGIC)
+	binary.BigEndian.PutUint16(r[4:6], uint16(flags))
+	binary.BigEndian.PutUint16(r[6:8], uint16(cmd))
+	binary.BigEndian.PutUint64(r[8:16], handle)
+	binary.BigEndian.PutUint64(r[16:24], off)
+	binary.BigEndian.PutUint64(r[24:32], length)
+	return r
+}
+
+func FuzzRequest(f *testing.F) {
+	f.Add(clientRequest(nbd_CMD_READ, 0, 1, 0, 4096))
+	f.Add(clientRequest(nbd_CMD_WRITE, nbd_CMD_FLAG_FUA, 2, fuzzSize-512, 512))
+	f.Add(clientRequest(nbd_CMD_WRITE_ZEROES, nbd_CMD_FLAG_NO_HOLE, 3, 1<<63, 1<<31))
+	f.Add(clientRequest(nbd_CMD_BLOCK_STATUS, nbd_CMD_FLAG_REQ_ONE|nbd_CMD_FLAG_NO_HOLE, 4, 0, fuzzSize))
+	f.Add(clientRequest(command(99), 0, 5, 0, 0))
+	f.Add(clientRequest(nbd_CMD_BLOCK_STATUS, 0, 6, 0, 0))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 28 {
+			return
+		}
+		req := request(data[:28])
+		ss := &serviceSocket{size: fuzzSize, flags: exportFlags(&Export{Storage: &fuzzStorage{}})}
+		code, err := ss.validate(req)
+		if err != nil {
+			if code == 0 {
+				t.Fatalf("refused request without an error code: %v", err)
+			}
+			return
+		}
+		allowed, ok := validFlags[req.command()]
+		if !ok {
+			t.Fatalf("accepted unknown command %d", req.command())
+		}
+		if req.flags()&^(allowed|nbd_CMD_FLAG_FUA) != 0 {
+			t.Fatalf("accepted flags %#x for command %d", req.flags(), req.command())
+		}
+		if req.command() == nbd_CMD_FLUSH {
+			return
+		}
+		if req.offset() > fuzzSize || uint64(req.len()) > fuzzSize-req.offset() {
+			t.Fatalf("accepted %d bytes at %d past the export size", req.len(), req.offset())
+		}
+		switch req.command() {
+		case nbd_CMD_TRIM, nbd_CMD_WRITE_ZEROES, nbd_CMD_BLOCK_STATUS:
+			if req.len() == 0 {
+				t.Fatalf("accepted command %d with a length of 0", req.command())
+			}
+		}
+	})
+}
+
+func FuzzServer(f *testing.F) {
+	f.Add(append(
+		clientRequest(nbd_CMD_WRITE, 0, 1, 0, 4),
+		append([]byte{1, 2, 3, 4}, clientRequest(nbd_CMD_READ, 0, 2, 0, 8192)...)...,
+	), false)
+	f.Add(append(
+		clientRequest(nbd_CMD_BLOCK_STATUS, nbd_CMD_FLAG_REQ_ONE, 1, 0, 4096),
+		clientRequest(nbd_CMD_READ, 0, 2, fuzzSize, 1)...,
+	), false)
+	f.Add(append(clientRequest(command(42), 1<<15, 1, 0, 0), clientRequest(nbd_CMD_DISC, 0, 2, 0, 0)...), false)
+	f.Add(append(
+		extendedRequest(nbd_CMD_WRITE_ZEROES, 0, 1, 0, fuzzSize),
+		extendedRequest(nbd_CMD_BLOCK_STATUS, 0, 2, 0, 1<<40)...,
+	), true)
+	f.Fuzz(func(t *testing.T, data []byte, extended bool) {
+		out := bytes.Buffer{}
+		storage := &fuzzStorage{data: make([]byte, fuzzSize)}
+		ss := &serviceSocket{
+			ReadWriter: struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewReader(data), &out},
+			Storage:           storage,
+			size:              fuzzSize,
+			flags:             exportFlags(&Export{Storage: storage}),
+			structuredReplies: true,
+			extendedHeaders:   extended,
+			baseAllocation:    true,
+		}
+		_ = ss.server(context.Background())
+
+		// with structured replies every reply carries its own length, so the stream must
+		// split into whole replies, and extended headers leave no simple replies
+		replies := out.Bytes()
+		for len(replies) > 0 {
+			if len(replies) < 16 {
+				t.Fatalf("truncated reply: %x", replies)
+			}
+			switch magic := binary.BigEndian.Uint32(replies[0:4]); {
+			case magic == nbd_REPLY_MAGIC && !extended:
+				replies = replies[16:]
+			case magic == nbd_EXTENDED_REPLY_MAGIC && extended:
+				if len(replies) < 32 {
+					t.Fatalf("truncated extended header: %x", replies)
+				}
+				length := binary.BigEndian.Uint64(replies[24:32])
+				if uint64(len(replies)-32) < length {
+					t.Fatalf("chunk of %d bytes only has %d", length, len(replies)-32)
+				}
+				replies = replies[32+length:]
+			case magic == nbd_STRUCTURED_REPLY_MAGIC && !extended:
+				if len(replies) < 20 {
+					t.Fatalf("truncated chunk header: %x", replies)
+				}
+				length := int(binary.BigEndian.Uint32(replies[16:20]))
+				if len(replies) < 20+length {
+					t.Fatalf("chunk of %d bytes only has %d", length, len(replies)-20)
+				}
+				replies = replies[20+length:]
+			default:
+				t.Fatalf("reply has wrong magic: %x", replies[0:4])
+			}
+		}
+	})
+}
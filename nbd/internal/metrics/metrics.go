@@ -0,0 +1,118 @@
+// Package metrics has the Prometheus metrics of the nbd server and the replica, and serves
+// them on /metrics
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "disk8s"
+
+// latencyBuckets run from 100µs for memory up to 26s for a struggling replica
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 4, 10)
+
+// NBD requests by export and command
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "requests_total",
+		Help: "NBD requests received.",
+	}, []string{"export", "command"})
+	RequestBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "request_bytes_total",
+		Help: "Bytes requested by NBD reads and writes that were not refused.",
+	}, []string{"export", "command"})
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "request_duration_seconds",
+		Help:    "Time to carry out NBD requests against storage.",
+		Buckets: latencyBuckets,
+	}, []string{"export", "command"})
+	RequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "requests_in_flight",
+		Help: "NBD requests being carried out against storage.",
+	}, []string{"export"})
+	RequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "request_errors_total",
+		Help: "NBD requests replied to with an error, by errno.",
+	}, []string{"export", "command", "errno"})
+	Connections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "connections",
+		Help: "Open NBD connections.",
+	}, []string{"export"})
+	ConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "nbd", Name: "connections_total",
+		Help: "NBD connections that negotiated an export.",
+	}, []string{"export"})
+)
+
+// gRPC calls between the nbd server and the replica, side is client or server
+var (
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "grpc", Name: "requests_total",
+		Help: "Storage gRPC calls by status code.",
+	}, []string{"side", "method", "code"})
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "grpc", Name: "request_duration_seconds",
+		Help:    "Time taken by storage gRPC calls.",
+		Buckets: latencyBuckets,
+	}, []string{"side", "method"})
+	grpcInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "grpc", Name: "requests_in_flight",
+		Help: "Storage gRPC calls in progress.",
+	}, []string{"side", "method"})
+)
+
+// observeGRPC tracks a call in flight, the returned func records how it ended
+func observeGRPC(side, fullMethod string) func(error) {
+	method := path.Base(fullMethod)
+	inFlight := grpcInFlight.WithLabelValues(side, method)
+	inFlight.Inc()
+	start := time.Now()
+	return func(err error) {
+		inFlight.Dec()
+		grpcDuration.WithLabelValues(side, method).Observe(time.Since(start).Seconds())
+		grpcRequests.WithLabelValues(side, method, status.Code(err).String()).Inc()
+	}
+}
+
+// UnaryServerInterceptor instruments the calls served by the replica
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	done := observeGRPC("server", info.FullMethod)
+	resp, err := handler(ctx, req)
+	done(err)
+	return resp, err
+}
+
+// UnaryClientInterceptor instruments the calls the nbd server makes to the replica
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	done := observeGRPC("client", method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	done(err)
+	return err
+}
+
+// Serve serves /metrics on the address until the context is done
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	fmt.Println("Serving metrics on", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/plockc/disk8s/nbd/replica/pb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errors returned by Storage are wrapped around one of these so the server can tell
+// the client what kind of failure happened
+var (
+	ErrOutOfRange = errors.New("out of range")
+	ErrNoSpace    = errors.New("no space left")
+	ErrIO         = errors.New("i/o failure")
+	ErrReadOnly   = errors.New("read-only")
+	ErrTimeout    = errors.New("timed out")
+)
+
+// fileError classifies an error from the filesystem
+func fileError(err error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+		kind = ErrNoSpace
+	case errors.Is(err, unix.EROFS), errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		kind = ErrReadOnly
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, unix.EINVAL):
+		kind = ErrOutOfRange
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		kind = ErrTimeout
+	default:
+		kind = ErrIO
+	}
+	return fmt.Errorf("%w: %v", kind, err)
+}
+
+var errorKinds = map[pb.StorageError_Kind]error{
+	pb.StorageError_IO:           ErrIO,
+	pb.StorageError_OUT_OF_RANGE: ErrOutOfRange,
+	pb.StorageError_NO_SPACE:     ErrNoSpace,
+	pb.StorageError_READ_ONLY:    ErrReadOnly,
+	pb.StorageError_TIMEOUT:      ErrTimeout,
+}
+
+var errorCodes = map[pb.StorageError_Kind]codes.Code{
+	pb.StorageError_IO:           codes.Internal,
+	pb.StorageError_OUT_OF_RANGE: codes.OutOfRange,
+	pb.StorageError_NO_SPACE:     codes.ResourceExhausted,
+	pb.StorageError_READ_ONLY:    codes.FailedPrecondition,
+	pb.StorageError_TIMEOUT:      codes.DeadlineExceeded,
+}
+
+// StatusError converts a Storage error to a gRPC status, with the kind of error in the
+// details so Remote can give back the same error
+func StatusError(err error) error {
+	kind := pb.StorageError_IO
+	for k, kindErr := range errorKinds {
+		if errors.Is(err, kindErr) {
+			kind = k
+			break
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		kind = pb.StorageError_TIMEOUT
+	}
+	st, detailsErr := status.New(errorCodes[kind], err.Error()).WithDetails(&pb.StorageError{Kind: kind})
+	if detailsErr != nil {
+		return status.Error(errorCodes[kind], err.Error())
+	}
+	return st.Err()
+}
+
+// remoteError converts an error from a gRPC call back into a Storage error
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	for _, detail := range st.Details() {
+		if storageErr, ok := detail.(*pb.StorageError); ok {
+			if kindErr, ok := errorKinds[storageErr.Kind]; ok {
+				return fmt.Errorf("%w: replica: %s", kindErr, st.Message())
+			}
+		}
+	}
+	switch st.Code() {
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %s", ErrTimeout, st.Message())
+	case codes.Canceled:
+		return fmt.Errorf("%w: %s", context.Canceled, st.Message())
+	}
+	return fmt.Errorf("%w: %s", ErrIO, st.Message())
+}
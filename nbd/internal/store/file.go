@@ -2,10 +2,13 @@ package store
 
 import (
 	"context"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+
+	"golang.org/x/sys/unix"
 )
 
 var diskSize uint64
@@ -30,6 +33,9 @@ func init() {
 
 var _ Storage = &File{}
 
+// fallocate is replaced in tests to act like a filesystem without hole punching
+var fallocate = unix.Fallocate
+
 type File struct {
 	*os.File
 }
@@ -51,29 +57,145 @@ func NewFile() (Storage, error) {
 		}
 	}
 	file.Close()
-	file, err = os.OpenFile(diskPath, os.O_CREATE|os.O_RDWR|os.O_SYNC, 0600)
+	// writes are made durable with Flush rather than syncing every write
+	file, err = os.OpenFile(diskPath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
 	return &File{file}, nil
 }
 
+// checkRange keeps requests within the disk, the file itself would grow for writes
+func checkRange(op string, off, length uint64) error {
+	if off+length > diskSize || off+length < off {
+		return fmt.Errorf(
+			"%w: cannot %s %d bytes starting at %d with disk size %d",
+			ErrOutOfRange, op, length, off, diskSize,
+		)
+	}
+	return nil
+}
+
 func (f *File) ReadAt(_ context.Context, p []byte, off uint64) error {
 	log.Printf("FILE READ at:%d, %d bytes\n", off, len(p))
-	if _, err := f.Seek(int64(off), 0); err != nil {
+	if err := checkRange("read", off, uint64(len(p))); err != nil {
 		return err
 	}
-	_, err := io.ReadFull(f, p)
-	return err
+	// positioned reads and writes are safe for the server to issue concurrently
+	_, err := f.File.ReadAt(p, int64(off))
+	return fileError(err)
 }
 
-func (f *File) WriteAt(_ context.Context, p []byte, off uint64) error {
-	log.Printf("FILE WRITE at:%d, %d bytes\n", off, len(p))
-	if _, err := f.Seek(int64(off), 0); err != nil {
+func (f *File) WriteAt(_ context.Context, p []byte, off uint64, fua bool) error {
+	log.Printf("FILE WRITE at:%d, %d bytes, fua: %v\n", off, len(p), fua)
+	if err := checkRange("write", off, uint64(len(p))); err != nil {
 		return err
 	}
-	_, err := f.Write(p)
-	return err
+	if _, err := f.File.WriteAt(p, int64(off)); err != nil {
+		return fileError(err)
+	}
+	if fua {
+		// the file size does not change, so only the data needs syncing
+		return fileError(unix.Fdatasync(int(f.Fd())))
+	}
+	return nil
+}
+
+func (f *File) Trim(_ context.Context, off, length uint64) error {
+	log.Printf("FILE TRIM at:%d, %d bytes\n", off, length)
+	if err := checkRange("trim", off, length); err != nil {
+		return err
+	}
+	// punching a hole gives the space back to the filesystem while keeping the file size
+	err := fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(off), int64(length))
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		// trim is only a hint, the data is fine if the filesystem cannot punch holes
+		log.Println("FILE TRIM not supported by filesystem")
+		return nil
+	}
+	return fileError(err)
+}
+
+func (f *File) WriteZeroes(_ context.Context, off, length uint64, noHole bool) error {
+	log.Printf("FILE WRITE ZEROES at:%d, %d bytes, no hole: %v\n", off, length, noHole)
+	if err := checkRange("write zeroes", off, length); err != nil {
+		return err
+	}
+	// zero range keeps the blocks allocated, punching a hole frees them
+	mode := uint32(unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE)
+	if !noHole {
+		mode = unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+	}
+	err := fallocate(int(f.Fd()), mode, int64(off), int64(length))
+	if !errors.Is(err, unix.EOPNOTSUPP) {
+		return fileError(err)
+	}
+	// the filesystem cannot zero for us, so fall back to writing zeroes
+	log.Println("FILE WRITE ZEROES not supported by filesystem, writing zeroes")
+	zeroes := make([]byte, 1024*1024)
+	for length > 0 {
+		n := uint64(len(zeroes))
+		if length < n {
+			n = length
+		}
+		if _, err := f.File.WriteAt(zeroes[:n], int64(off)); err != nil {
+			return fileError(err)
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// lseek whence values to find data and holes in a sparse file
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func (f *File) Extents(_ context.Context, off, length uint64) ([]Extent, error) {
+	log.Printf("FILE EXTENTS at:%d, %d bytes\n", off, length)
+	if err := checkRange("find extents for", off, length); err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	end := int64(off + length)
+	var extents []Extent
+	for pos := int64(off); pos < end; {
+		dataStart, err := unix.Seek(fd, pos, seekData)
+		if errors.Is(err, unix.ENXIO) {
+			// there is no more data in the file
+			dataStart = end
+		} else if errors.Is(err, unix.EINVAL) && len(extents) == 0 {
+			// the filesystem cannot tell us about holes, so everything is data
+			return []Extent{{Length: length}}, nil
+		} else if err != nil {
+			return nil, fileError(err)
+		}
+		if dataStart > end {
+			dataStart = end
+		}
+		if dataStart > pos {
+			extents = append(extents, Extent{Length: uint64(dataStart - pos), Hole: true})
+			pos = dataStart
+			continue
+		}
+		holeStart, err := unix.Seek(fd, pos, seekHole)
+		if err != nil {
+			return nil, fileError(err)
+		}
+		if holeStart > end {
+			holeStart = end
+		}
+		extents = append(extents, Extent{Length: uint64(holeStart - pos)})
+		pos = holeStart
+	}
+	return extents, nil
+}
+
+func (f *File) Flush(_ context.Context) error {
+	log.Println("FILE FLUSH")
+	return fileError(f.Sync())
 }
 
 func (f *File) Release() {
@@ -84,3 +206,9 @@ func (f *File) Release() {
 func (f *File) Size(_ context.Context) (uint64, error) {
 	return diskSize, nil
 }
+
+// Capabilities of a file, trim and write zeroes fall back when the filesystem cannot
+// punch holes or zero ranges
+func (f *File) Capabilities() Capabilities {
+	return Capabilities{Flush: true, FUA: true, Trim: true, WriteZeroes: true, MultiConn: true, BlockSizes: defaultBlockSizes}
+}
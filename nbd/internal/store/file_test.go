@@ -0,0 +1,212 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestFile is a sparse file of the disk size in a temporary directory
+func newTestFile(t *testing.T) *File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(int64(diskSize)); err != nil {
+		t.Fatal(err)
+	}
+	file := &File{f}
+	t.Cleanup(file.Release)
+	return file
+}
+
+// withFallocate has fallocate fail with err for the rest of the test
+func withFallocate(t *testing.T, err error) {
+	t.Helper()
+	fallocate = func(int, uint32, int64, int64) error { return err }
+	t.Cleanup(func() { fallocate = unix.Fallocate })
+}
+
+// readBlocks reads n blocks of 4096 bytes from the start of the storage
+func readBlocks(t *testing.T, s Storage, n int) []byte {
+	t.Helper()
+	p := make([]byte, n*4096)
+	if err := s.ReadAt(context.Background(), p, 0); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// checkBlocks checks which of the blocks read back as zeroes, the rest as 0xff
+func checkBlocks(t *testing.T, p []byte, zeroed ...bool) {
+	t.Helper()
+	for i, zero := range zeroed {
+		want := byte(0xff)
+		if zero {
+			want = 0
+		}
+		if !bytes.Equal(p[i*4096:(i+1)*4096], bytes.Repeat([]byte{want}, 4096)) {
+			t.Errorf("block %d is not all %#x", i, want)
+		}
+	}
+}
+
+// fillBlocks writes n blocks of 0xff from the start of the storage
+func fillBlocks(t *testing.T, s Storage, n int) {
+	t.Helper()
+	if err := s.WriteAt(context.Background(), bytes.Repeat([]byte{0xff}, n*4096), 0, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileTrim(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFile(t)
+	fillBlocks(t, f, 3)
+	if err := f.Trim(ctx, 4096, 4096); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, readBlocks(t, f, 3), false, true, false)
+	extents, err := f.Extents(ctx, 0, 3*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Extent{{Length: 4096}, {Length: 4096, Hole: true}, {Length: 4096}}; fmt.Sprint(extents) != fmt.Sprint(want) {
+		t.Fatalf("extents after trim %v, expected %v", extents, want)
+	}
+	if err := f.Trim(ctx, diskSize-4096, 8192); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("trim past the end got %v", err)
+	}
+}
+
+func TestFileTrimUnsupported(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFile(t)
+	fillBlocks(t, f, 2)
+
+	// trim is a hint, so a filesystem that cannot punch holes is not an error
+	withFallocate(t, unix.EOPNOTSUPP)
+	if err := f.Trim(ctx, 0, 4096); err != nil {
+		t.Fatalf("unsupported trim got %v", err)
+	}
+	checkBlocks(t, readBlocks(t, f, 2), false, false)
+
+	withFallocate(t, unix.EIO)
+	if err := f.Trim(ctx, 0, 4096); !errors.Is(err, ErrIO) {
+		t.Fatalf("failed trim got %v", err)
+	}
+}
+
+func TestFileWriteZeroes(t *testing.T) {
+	tests := []struct {
+		name   string
+		noHole bool
+		mode   uint32
+		hole   bool
+	}{
+		{"punch hole", false, unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE, true},
+		{"no hole", true, unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newTestFile(t)
+			fillBlocks(t, f, 3)
+			var mode uint32
+			fallocate = func(fd int, m uint32, off, length int64) error {
+				mode = m
+				return unix.Fallocate(fd, m, off, length)
+			}
+			t.Cleanup(func() { fallocate = unix.Fallocate })
+
+			if err := f.WriteZeroes(ctx, 4096, 4096, test.noHole); err != nil {
+				t.Fatal(err)
+			}
+			if mode != test.mode {
+				t.Fatalf("fallocate mode %#x, expected %#x", mode, test.mode)
+			}
+			checkBlocks(t, readBlocks(t, f, 3), false, true, false)
+			if !test.hole {
+				// zeroed but allocated blocks may still be reported as holes by the filesystem
+				return
+			}
+			extents, err := f.Extents(ctx, 4096, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []Extent{{Length: 4096, Hole: true}}; fmt.Sprint(extents) != fmt.Sprint(want) {
+				t.Fatalf("extents after write zeroes %v, expected %v", extents, want)
+			}
+		})
+	}
+}
+
+func TestFileWriteZeroesFallback(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFile(t)
+	// more than one chunk of the fallback, with an unaligned end
+	length := uint64(2<<20 + 100)
+	if err := f.WriteAt(ctx, bytes.Repeat([]byte{0xff}, int(length)+8192), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	withFallocate(t, unix.EOPNOTSUPP)
+	if err := f.WriteZeroes(ctx, 4096, length, false); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, length+8192)
+	if err := f.ReadAt(ctx, p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p[4096:4096+length], make([]byte, length)) {
+		t.Fatal("fallback did not write zeroes over the range")
+	}
+	if p[4095] != 0xff || p[4096+length] != 0xff {
+		t.Fatal("fallback wrote zeroes outside the range")
+	}
+	// the zeroes were written, so they are data rather than a hole
+	extents, err := f.Extents(ctx, 4096, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Extent{{Length: length}}; fmt.Sprint(extents) != fmt.Sprint(want) {
+		t.Fatalf("extents after fallback %v, expected %v", extents, want)
+	}
+}
+
+func TestFileExtents(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFile(t)
+	if err := f.WriteAt(ctx, make([]byte, 4096), 8192, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		off, length uint64
+		want        []Extent
+	}{
+		{0, 32768, []Extent{{Length: 8192, Hole: true}, {Length: 4096}, {Length: 20480, Hole: true}}},
+		{8192, 4096, []Extent{{Length: 4096}}},
+		{10000, 100, []Extent{{Length: 100}}},
+		{12288, 512, []Extent{{Length: 512, Hole: true}}},
+		// past the last data the file is a hole to the end of the disk
+		{8192, diskSize - 8192, []Extent{{Length: 4096}, {Length: diskSize - 12288, Hole: true}}},
+	}
+	for _, test := range tests {
+		extents, err := f.Extents(ctx, test.off, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(extents) != fmt.Sprint(test.want) {
+			t.Errorf("extents of %d bytes at %d are %v, expected %v", test.length, test.off, extents, test.want)
+		}
+	}
+	if _, err := f.Extents(ctx, diskSize, 1); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("extents past the end got %v", err)
+	}
+}
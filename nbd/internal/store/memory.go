@@ -4,44 +4,140 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 )
 
 var _ Storage = &Memory{}
 
+// memoryBlockSize is the granularity Memory tracks which ranges have been written
+const memoryBlockSize = 4096
+
 type Memory struct {
+	// the server issues requests concurrently
+	mu   sync.RWMutex
 	data []byte
+	// allocated marks the blocks that have been written since they were last trimmed
+	allocated []bool
 }
 
 func NewMemory() Storage {
 	m := Memory{}
 	m.data = make([]byte, diskSize)
+	m.allocated = make([]bool, (diskSize+memoryBlockSize-1)/memoryBlockSize)
 	return &m
 }
 
-func (m *Memory) ReadAt(_ context.Context, p []byte, off uint64) error {
-	if int(off)+len(p) > len(m.data) {
+// checkRange keeps requests within the data, without overflowing on a bad offset
+func (m *Memory) checkRange(op string, off, length uint64) error {
+	size := uint64(len(m.data))
+	if off > size || length > size-off {
 		return fmt.Errorf(
-			"cannot read %d bytes starting at %d with disk size %d",
-			len(p), off, len(m.data),
+			"%w: cannot %s %d bytes starting at %d with disk size %d",
+			ErrOutOfRange, op, length, off, size,
 		)
 	}
-	copy(p, m.data[off:int(off)+len(p)])
+	return nil
+}
+
+func (m *Memory) ReadAt(_ context.Context, p []byte, off uint64) error {
+	if err := m.checkRange("read", off, uint64(len(p))); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	copy(p, m.data[off:off+uint64(len(p))])
+	m.mu.RUnlock()
 	log.Printf("MEMORY READ at:%d, %d bytes\n", off, len(p))
 	return nil
 }
 
-func (m *Memory) WriteAt(_ context.Context, p []byte, off uint64) error {
-	if int(off)+len(p) > len(m.data) {
-		return fmt.Errorf(
-			"cannot write %d bytes starting at %d with disk size %d",
-			len(p), off, len(m.data),
-		)
+func (m *Memory) WriteAt(_ context.Context, p []byte, off uint64, _ bool) error {
+	if err := m.checkRange("write", off, uint64(len(p))); err != nil {
+		return err
 	}
+	m.mu.Lock()
 	copy(m.data[off:], p)
+	m.allocate(off, uint64(len(p)))
+	m.mu.Unlock()
 	log.Printf("MEMORY WRITE at:%d, %d bytes\n", off, len(p))
 	return nil
 }
 
+func (m *Memory) Trim(_ context.Context, off, length uint64) error {
+	if err := m.checkRange("trim", off, length); err != nil {
+		return err
+	}
+	// there is no backing store to give space back to, so just drop the bytes
+	m.zero(off, length, false)
+	log.Printf("MEMORY TRIM at:%d, %d bytes\n", off, length)
+	return nil
+}
+
+func (m *Memory) WriteZeroes(_ context.Context, off, length uint64, noHole bool) error {
+	if err := m.checkRange("write zeroes", off, length); err != nil {
+		return err
+	}
+	m.zero(off, length, noHole)
+	log.Printf("MEMORY WRITE ZEROES at:%d, %d bytes\n", off, length)
+	return nil
+}
+
+// zero clears the range, blocks entirely within the range become holes unless allocate is set
+func (m *Memory) zero(off, length uint64, allocate bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := off; i < off+length; i++ {
+		m.data[i] = 0
+	}
+	if allocate {
+		m.allocate(off, length)
+		return
+	}
+	first := (off + memoryBlockSize - 1) / memoryBlockSize
+	for block := first; (block+1)*memoryBlockSize <= off+length; block++ {
+		m.allocated[block] = false
+	}
+}
+
+// allocate marks every block touching the range as written, callers hold the lock
+func (m *Memory) allocate(off, length uint64) {
+	if length == 0 {
+		return
+	}
+	for block := off / memoryBlockSize; block*memoryBlockSize < off+length; block++ {
+		m.allocated[block] = true
+	}
+}
+
+func (m *Memory) Extents(_ context.Context, off, length uint64) ([]Extent, error) {
+	if err := m.checkRange("find extents for", off, length); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var extents []Extent
+	for pos := off; pos < off+length; {
+		block := pos / memoryBlockSize
+		end := (block + 1) * memoryBlockSize
+		if end > off+length {
+			end = off + length
+		}
+		hole := !m.allocated[block]
+		if len(extents) > 0 && extents[len(extents)-1].Hole == hole {
+			extents[len(extents)-1].Length += end - pos
+		} else {
+			extents = append(extents, Extent{Length: end - pos, Hole: hole})
+		}
+		pos = end
+	}
+	log.Printf("MEMORY EXTENTS at:%d, %d bytes\n", off, length)
+	return extents, nil
+}
+
+func (m *Memory) Flush(_ context.Context) error {
+	log.Println("MEMORY FLUSH")
+	return nil
+}
+
 func (m *Memory) Release() {
 	log.Println("MEMORY DISCONNECT")
 }
@@ -49,3 +145,8 @@ func (m *Memory) Release() {
 func (m *Memory) Size(_ context.Context) (uint64, error) {
 	return uint64(len(m.data)), nil
 }
+
+// Capabilities of memory are all trivially supported, nothing is ever durable anyway
+func (m *Memory) Capabilities() Capabilities {
+	return Capabilities{Flush: true, FUA: true, Trim: true, WriteZeroes: true, MultiConn: true, BlockSizes: defaultBlockSizes}
+}
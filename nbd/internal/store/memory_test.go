@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMemoryTrim(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	fillBlocks(t, m, 3)
+	// only whole blocks become holes, the edges of the range are zeroed in place
+	if err := m.Trim(ctx, 2048, 8192); err != nil {
+		t.Fatal(err)
+	}
+	p := readBlocks(t, m, 3)
+	if !bytes.Equal(p[2048:10240], make([]byte, 8192)) || p[2047] != 0xff || p[10240] != 0xff {
+		t.Fatal("trim did not zero exactly its range")
+	}
+	extents, err := m.Extents(ctx, 0, 3*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Extent{{Length: 4096}, {Length: 4096, Hole: true}, {Length: 4096}}; fmt.Sprint(extents) != fmt.Sprint(want) {
+		t.Fatalf("extents after trim %v, expected %v", extents, want)
+	}
+}
+
+func TestMemoryWriteZeroes(t *testing.T) {
+	tests := []struct {
+		name        string
+		off, length uint64
+		noHole      bool
+		want        []Extent
+	}{
+		{"hole", 4096, 8192, false, []Extent{{Length: 4096}, {Length: 8192, Hole: true}}},
+		{"partial blocks stay allocated", 100, 8000, false, []Extent{{Length: 3 * 4096}}},
+		{"no hole", 4096, 8192, true, []Extent{{Length: 3 * 4096}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			m := NewMemory()
+			fillBlocks(t, m, 3)
+			if err := m.WriteZeroes(ctx, test.off, test.length, test.noHole); err != nil {
+				t.Fatal(err)
+			}
+			p := readBlocks(t, m, 3)
+			for i, b := range p {
+				zeroed := uint64(i) >= test.off && uint64(i) < test.off+test.length
+				if zeroed != (b == 0) {
+					t.Fatalf("byte %d is %#x after write zeroes", i, b)
+				}
+			}
+			extents, err := m.Extents(ctx, 0, 3*4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(extents) != fmt.Sprint(test.want) {
+				t.Fatalf("extents after write zeroes %v, expected %v", extents, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryExtents(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	// a write of a few bytes allocates every block it touches
+	if err := m.WriteAt(ctx, []byte("data"), 8190, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteAt(ctx, []byte{1}, 5*4096+10, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		off, length uint64
+		want        []Extent
+	}{
+		{0, 8 * 4096, []Extent{{Length: 4096, Hole: true}, {Length: 8192}, {Length: 8192, Hole: true}, {Length: 4096}, {Length: 8192, Hole: true}}},
+		{4000, 200, []Extent{{Length: 96, Hole: true}, {Length: 104}}},
+		{5*4096 + 100, 100, []Extent{{Length: 100}}},
+		{6 * 4096, 1, []Extent{{Length: 1, Hole: true}}},
+	}
+	for _, test := range tests {
+		extents, err := m.Extents(ctx, test.off, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(extents) != fmt.Sprint(test.want) {
+			t.Errorf("extents of %d bytes at %d are %v, expected %v", test.length, test.off, extents, test.want)
+		}
+	}
+}
+
+func TestMemoryOutOfRange(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	tests := []struct {
+		off, length uint64
+	}{
+		{diskSize - 1, 2},
+		{diskSize, 1},
+		// offsets that would wrap around to within the data
+		{1<<64 - 1, 2},
+		{1 << 63, 4096},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.length)
+		if err := m.ReadAt(ctx, p, test.off); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("read of %d bytes at %d got %v", test.length, test.off, err)
+		}
+		if err := m.WriteAt(ctx, p, test.off, false); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("write of %d bytes at %d got %v", test.length, test.off, err)
+		}
+		if err := m.Trim(ctx, test.off, test.length); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("trim of %d bytes at %d got %v", test.length, test.off, err)
+		}
+		if err := m.WriteZeroes(ctx, test.off, test.length, false); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("write zeroes of %d bytes at %d got %v", test.length, test.off, err)
+		}
+		if _, err := m.Extents(ctx, test.off, test.length); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("extents of %d bytes at %d got %v", test.length, test.off, err)
+		}
+	}
+}
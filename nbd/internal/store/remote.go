@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 
+	"github.com/plockc/disk8s/nbd/internal/metrics"
 	"github.com/plockc/disk8s/nbd/replica/pb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -15,7 +16,10 @@ type Remote struct {
 }
 
 func NewRemote(hostPort string) (Storage, error) {
-	conn, err := grpc.Dial(hostPort, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(hostPort,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(metrics.UnaryClientInterceptor),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -27,18 +31,67 @@ func NewRemote(hostPort string) (Storage, error) {
 
 func (r *Remote) ReadAt(ctx context.Context, p []byte, off uint64) error {
 	log.Printf("GRPC REQUEST READ at:%d, %d bytes\n", off, len(p))
-	resp, err := r.client.Read(ctx, &pb.ReadReq{Size: uint32(len(p)), Offset: off})
-	if err != nil {
-		return err
+	// clients that did not negotiate block sizes may read up to 32MiB at once, which is
+	// split to keep each message under the gRPC limit
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxRemoteMessage {
+			n = maxRemoteMessage
+		}
+		resp, err := r.client.Read(ctx, &pb.ReadReq{Size: uint32(n), Offset: off})
+		if err != nil {
+			return remoteError(err)
+		}
+		copy(p[:n], resp.Data)
+		p, off = p[n:], off+uint64(n)
+	}
+	return nil
+}
+
+func (r *Remote) WriteAt(ctx context.Context, p []byte, off uint64, fua bool) error {
+	log.Printf("GRPC REQUEST WRITE at:%d, %d bytes, fua: %v\n", off, len(p), fua)
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxRemoteMessage {
+			n = maxRemoteMessage
+		}
+		if _, err := r.client.Write(ctx, &pb.WriteReq{Data: p[:n], Offset: off, Fua: fua}); err != nil {
+			return remoteError(err)
+		}
+		p, off = p[n:], off+uint64(n)
 	}
-	copy(p, resp.Data)
 	return nil
 }
 
-func (r *Remote) WriteAt(ctx context.Context, p []byte, off uint64) error {
-	log.Printf("GRPC REQUEST WRITE at:%d, %d bytes\n", off, len(p))
-	_, err := r.client.Write(ctx, &pb.WriteReq{Data: p, Offset: off})
-	return err
+func (r *Remote) Trim(ctx context.Context, off, length uint64) error {
+	log.Printf("GRPC REQUEST TRIM at:%d, %d bytes\n", off, length)
+	_, err := r.client.Trim(ctx, &pb.TrimReq{Offset: off, Length: length})
+	return remoteError(err)
+}
+
+func (r *Remote) WriteZeroes(ctx context.Context, off, length uint64, noHole bool) error {
+	log.Printf("GRPC REQUEST WRITE ZEROES at:%d, %d bytes\n", off, length)
+	_, err := r.client.WriteZeroes(ctx, &pb.WriteZeroesReq{Offset: off, Length: length, NoHole: noHole})
+	return remoteError(err)
+}
+
+func (r *Remote) Extents(ctx context.Context, off, length uint64) ([]Extent, error) {
+	log.Printf("GRPC REQUEST EXTENTS at:%d, %d bytes\n", off, length)
+	resp, err := r.client.Extents(ctx, &pb.ExtentsReq{Offset: off, Length: length})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	extents := make([]Extent, len(resp.Extents))
+	for i, e := range resp.Extents {
+		extents[i] = Extent{Length: e.Length, Hole: e.Hole}
+	}
+	return extents, nil
+}
+
+func (r *Remote) Flush(ctx context.Context) error {
+	log.Println("GRPC REQUEST FLUSH")
+	_, err := r.client.Flush(ctx, &pb.FlushReq{})
+	return remoteError(err)
 }
 
 func (r *Remote) Release() {
@@ -46,11 +99,24 @@ func (r *Remote) Release() {
 	r.conn.Close()
 }
 
+// maxRemoteMessage keeps the data of each read and write under the default gRPC message
+// limit of 4MiB
+const maxRemoteMessage = 2 * 1024 * 1024
+
+// remoteBlockSizes favor large requests to make the most of each round trip, larger
+// ones are split across several
+var remoteBlockSizes = BlockSizes{Minimum: 1, Preferred: 1024 * 1024, Maximum: maxRemoteMessage}
+
+// Capabilities of the replica, which serves every operation from its own storage
+func (r *Remote) Capabilities() Capabilities {
+	return Capabilities{Flush: true, FUA: true, Trim: true, WriteZeroes: true, MultiConn: true, BlockSizes: remoteBlockSizes}
+}
+
 func (r *Remote) Size(ctx context.Context) (uint64, error) {
 	log.Printf("GRPC REQUEST SIZE")
 	resp, err := r.client.Size(ctx, &pb.SizeReq{})
 	if err != nil {
-		return 0, err
+		return 0, remoteError(err)
 	}
 	return resp.Size, nil
 }
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/plockc/disk8s/nbd/replica/pb"
+	"google.golang.org/grpc"
+)
+
+// fakeReplica serves reads and writes from memory, refusing messages over the gRPC limit
+type fakeReplica struct {
+	pb.DataDiskClient
+	t    *testing.T
+	data []byte
+	// calls counts the messages sent
+	calls int
+}
+
+func (f *fakeReplica) Read(_ context.Context, req *pb.ReadReq, _ ...grpc.CallOption) (*pb.ReadResp, error) {
+	f.calls++
+	if req.Size > maxRemoteMessage {
+		f.t.Fatalf("read of %d bytes in one message", req.Size)
+	}
+	return &pb.ReadResp{Data: f.data[req.Offset : req.Offset+uint64(req.Size)]}, nil
+}
+
+func (f *fakeReplica) Write(_ context.Context, req *pb.WriteReq, _ ...grpc.CallOption) (*pb.WriteResp, error) {
+	f.calls++
+	if len(req.Data) > maxRemoteMessage {
+		f.t.Fatalf("write of %d bytes in one message", len(req.Data))
+	}
+	copy(f.data[req.Offset:], req.Data)
+	return &pb.WriteResp{}, nil
+}
+
+func TestRemoteSplitsLargeRequests(t *testing.T) {
+	ctx := context.Background()
+	replica := &fakeReplica{t: t, data: make([]byte, 40<<20)}
+	r := &Remote{client: replica}
+
+	// the largest payload an NBD client may send without negotiating block sizes
+	data := make([]byte, 32<<20+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := r.WriteAt(ctx, data, 1000, false); err != nil {
+		t.Fatal(err)
+	}
+	if replica.calls != 17 {
+		t.Fatalf("write took %d messages, expected 17", replica.calls)
+	}
+	if !bytes.Equal(replica.data[1000:1000+len(data)], data) {
+		t.Fatal("replica has different data than was written")
+	}
+	got := make([]byte, len(data))
+	if err := r.ReadAt(ctx, got, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read back different data than was written")
+	}
+}
@@ -2,9 +2,53 @@ package store
 
 import "context"
 
+// Extent is a run of storage that is either allocated or a hole, holes read as zeroes
+type Extent struct {
+	Length uint64
+	Hole   bool
+}
+
+// BlockSizes constrain requests to a Storage, the minimum is the alignment it needs,
+// the preferred size is the alignment and size it handles efficiently, and the maximum
+// is the most it takes in one request
+type BlockSizes struct {
+	Minimum   uint32
+	Preferred uint32
+	Maximum   uint32
+}
+
+// defaultBlockSizes suit storage that takes any request the server accepts
+var defaultBlockSizes = BlockSizes{Minimum: 1, Preferred: 4096, Maximum: 32 * 1024 * 1024}
+
+// Capabilities describe what a Storage can do, the server advertises them to clients
+type Capabilities struct {
+	// ReadOnly storage refuses every write
+	ReadOnly bool
+	// Flush and FUA make writes durable
+	Flush bool
+	FUA   bool
+	// Trim and WriteZeroes are worth sending rather than having clients write zeroes
+	Trim        bool
+	WriteZeroes bool
+	// MultiConn storage gives every connection the same view, a flush on one connection
+	// makes the writes completed on all of them durable
+	MultiConn  bool
+	BlockSizes BlockSizes
+}
+
 type Storage interface {
 	ReadAt(ctx context.Context, p []byte, off uint64) error
-	WriteAt(ctx context.Context, p []byte, off uint64) error
+	// WriteAt writes p at the offset, and when fua is set the data is durable before returning
+	WriteAt(ctx context.Context, p []byte, off uint64, fua bool) error
+	// Flush makes all completed writes durable
+	Flush(ctx context.Context) error
+	// Trim discards the data in the range, which reads back as zeroes
+	Trim(ctx context.Context, off, length uint64) error
+	// WriteZeroes writes zeroes to the range, possibly as a hole unless noHole is set
+	WriteZeroes(ctx context.Context, off, length uint64, noHole bool) error
+	// Extents describes which parts of the range are allocated, covering the whole range
+	Extents(ctx context.Context, off, length uint64) ([]Extent, error)
 	Size(ctx context.Context) (uint64, error)
+	Capabilities() Capabilities
 	Release()
 }
@@ -0,0 +1,137 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// metadata contexts select what nbd_CMD_BLOCK_STATUS reports, only base:allocation
+// is supported, which reports holes and zeroes
+const (
+	baseAllocation   = "base:allocation"
+	baseAllocationID = 1
+
+	nbd_STATE_HOLE uint32 = 1 << 0
+	nbd_STATE_ZERO uint32 = 1 << 1
+)
+
+// parseMetaContextRequest parses the payload of nbd_OPT_LIST_META_CONTEXT and
+// nbd_OPT_SET_META_CONTEXT into the export name and the context queries
+func parseMetaContextRequest(data []byte) (name string, queries []string, err error) {
+	readString := func() (string, error) {
+		if len(data) < 4 {
+			return "", fmt.Errorf("meta context request is truncated")
+		}
+		length := binary.BigEndian.Uint32(data[0:4])
+		if uint64(length)+4 > uint64(len(data)) {
+			return "", fmt.Errorf("string length %d overruns meta context request", length)
+		}
+		s := string(data[4 : 4+length])
+		data = data[4+length:]
+		return s, nil
+	}
+	if name, err = readString(); err != nil {
+		return "", nil, err
+	}
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("meta context request is missing the number of queries")
+	}
+	numQueries := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+	for i := uint32(0); i < numQueries; i++ {
+		query, err := readString()
+		if err != nil {
+			return "", nil, err
+		}
+		queries = append(queries, query)
+	}
+	if len(data) != 0 {
+		return "", nil, fmt.Errorf("%d unexpected bytes after meta context queries", len(data))
+	}
+	return name, queries, nil
+}
+
+// matchesBaseAllocation checks if any query selects base:allocation, listing with no
+// queries matches every context
+func matchesBaseAllocation(queries []string, listing bool) bool {
+	if listing && len(queries) == 0 {
+		return true
+	}
+	for _, query := range queries {
+		if query == baseAllocation || (listing && query == "base:") {
+			return true
+		}
+	}
+	return false
+}
+
+// metaContextReply is the payload of nbd_REP_META_CONTEXT
+func metaContextReply(id uint32, name string) []byte {
+	reply := make([]byte, 4+len(name))
+	binary.BigEndian.PutUint32(reply[0:4], id)
+	copy(reply[4:], name)
+	return reply
+}
+
+// blockStatusChunk replies to nbd_CMD_BLOCK_STATUS with the base:allocation state of
+// each extent
+func (ss *serviceSocket) blockStatusChunk(req request, extents []store.Extent) response {
+	if ss.extendedHeaders {
+		return ss.blockStatusExtChunk(req, extents)
+	}
+	payload := make([]byte, 4+8*len(extents))
+	binary.BigEndian.PutUint32(payload[0:4], baseAllocationID)
+	for i, extent := range extents {
+		var state uint32
+		if extent.Hole {
+			state = nbd_STATE_HOLE | nbd_STATE_ZERO
+		}
+		binary.BigEndian.PutUint32(payload[4+8*i:8+8*i], uint32(extent.Length))
+		binary.BigEndian.PutUint32(payload[8+8*i:12+8*i], state)
+	}
+	header := ss.chunkHeader(req, nbd_REPLY_FLAG_DONE, nbd_REPLY_TYPE_BLOCK_STATUS, uint64(len(payload)))
+	return response{header, payload}
+}
+
+// blockStatusExtChunk is the extended headers form of blockStatusChunk, with a count of
+// the extents and 64 bit lengths
+func (ss *serviceSocket) blockStatusExtChunk(req request, extents []store.Extent) response {
+	payload := make([]byte, 8+16*len(extents))
+	binary.BigEndian.PutUint32(payload[0:4], baseAllocationID)
+	binary.BigEndian.PutUint32(payload[4:8], uint32(len(extents)))
+	for i, extent := range extents {
+		var state uint64
+		if extent.Hole {
+			state = uint64(nbd_STATE_HOLE | nbd_STATE_ZERO)
+		}
+		binary.BigEndian.PutUint64(payload[8+16*i:16+16*i], extent.Length)
+		binary.BigEndian.PutUint64(payload[16+16*i:24+16*i], state)
+	}
+	header := ss.chunkHeader(req, nbd_REPLY_FLAG_DONE, nbd_REPLY_TYPE_BLOCK_STATUS_EXT, uint64(len(payload)))
+	return response{header, payload}
+}
+
+// trimExtents clips the extents to the length of the request, and to one extent if the
+// client only asked for one
+func trimExtents(extents []store.Extent, length uint64, reqOne bool) []store.Extent {
+	var trimmed []store.Extent
+	for _, extent := range extents {
+		if length == 0 {
+			break
+		}
+		if extent.Length == 0 {
+			continue
+		}
+		if extent.Length > length {
+			extent.Length = length
+		}
+		length -= extent.Length
+		trimmed = append(trimmed, extent)
+		if reqOne {
+			break
+		}
+	}
+	return trimmed
+}
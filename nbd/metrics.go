@@ -0,0 +1,75 @@
+package nbd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/metrics"
+)
+
+// commandNames label the metrics, anything else a client sends is "unknown" so a
+// misbehaving client cannot blow up the number of series
+var commandNames = map[command]string{
+	nbd_CMD_READ:         "read",
+	nbd_CMD_WRITE:        "write",
+	nbd_CMD_DISC:         "disc",
+	nbd_CMD_FLUSH:        "flush",
+	nbd_CMD_TRIM:         "trim",
+	nbd_CMD_WRITE_ZEROES: "write_zeroes",
+	nbd_CMD_BLOCK_STATUS: "block_status",
+}
+
+var errnoNames = map[uint32]string{
+	nbd_EPERM:     "EPERM",
+	nbd_EIO:       "EIO",
+	nbd_EINVAL:    "EINVAL",
+	nbd_ENOSPC:    "ENOSPC",
+	nbd_ESHUTDOWN: "ESHUTDOWN",
+	nbd_ETIMEDOUT: "ETIMEDOUT",
+}
+
+func commandName(cmd command) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func errnoName(code uint32) string {
+	if name, ok := errnoNames[code]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(code), 10)
+}
+
+// observe counts the request and tracks it in flight, the returned func records how
+// long it took
+func (ss *serviceSocket) observe(req request) func() {
+	cmd := commandName(req.command())
+	metrics.Requests.WithLabelValues(ss.export, cmd).Inc()
+	inFlight := metrics.RequestsInFlight.WithLabelValues(ss.export)
+	inFlight.Inc()
+	start := time.Now()
+	return func() {
+		inFlight.Dec()
+		metrics.RequestDuration.WithLabelValues(ss.export, cmd).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeBytes counts the data of a read or write once it is accepted, the length of a
+// refused request is whatever the client made up
+func (ss *serviceSocket) observeBytes(req request) {
+	switch req.command() {
+	case nbd_CMD_READ, nbd_CMD_WRITE:
+		metrics.RequestBytes.WithLabelValues(ss.export, commandName(req.command())).Add(float64(req.len()))
+	}
+}
+
+// observeConnection counts the connection to the export, the returned func is called
+// once it closes
+func observeConnection(export string) func() {
+	metrics.ConnectionsTotal.WithLabelValues(export).Inc()
+	open := metrics.Connections.WithLabelValues(export)
+	open.Inc()
+	return open.Dec
+}
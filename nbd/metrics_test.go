@@ -0,0 +1,66 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	// the metrics are global, a fresh export keeps other tests and runs out of the counts
+	export := fmt.Sprintf("metrics-%d", time.Now().UnixNano())
+	storage := &fuzzStorage{data: make([]byte, fuzzSize)}
+	in := append(clientRequest(nbd_CMD_WRITE, 0, 1, 0, 1024), make([]byte, 1024)...)
+	in = append(in, clientRequest(nbd_CMD_READ, 0, 2, 0, 512)...)
+	in = append(in, clientRequest(nbd_CMD_READ, 0, 3, fuzzSize, 4096)...)
+	in = append(in, clientRequest(command(42), 0, 4, 0, 0)...)
+	in = append(in, clientRequest(nbd_CMD_DISC, 0, 5, 0, 0)...)
+	ss := &serviceSocket{
+		ReadWriter: struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(in), io.Discard},
+		Storage: storage,
+		export:  export,
+		size:    fuzzSize,
+		flags:   exportFlags(&Export{Storage: storage, ReadOnly: true}),
+	}
+	closed := observeConnection(export)
+	if err := ss.server(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(metrics.Connections.WithLabelValues(export)); got != 1 {
+		t.Errorf("%v connections open, expected 1", got)
+	}
+	closed()
+
+	tests := []struct {
+		name   string
+		metric float64
+		want   float64
+	}{
+		{"write requests", testutil.ToFloat64(metrics.Requests.WithLabelValues(export, "write")), 1},
+		{"read requests", testutil.ToFloat64(metrics.Requests.WithLabelValues(export, "read")), 2},
+		{"unknown requests", testutil.ToFloat64(metrics.Requests.WithLabelValues(export, "unknown")), 1},
+		// only the read within the export is counted, the refused requests moved no data
+		{"read bytes", testutil.ToFloat64(metrics.RequestBytes.WithLabelValues(export, "read")), 512},
+		{"write bytes", testutil.ToFloat64(metrics.RequestBytes.WithLabelValues(export, "write")), 0},
+		{"write errors", testutil.ToFloat64(metrics.RequestErrors.WithLabelValues(export, "write", "EPERM")), 1},
+		{"read errors", testutil.ToFloat64(metrics.RequestErrors.WithLabelValues(export, "read", "EINVAL")), 1},
+		{"unknown errors", testutil.ToFloat64(metrics.RequestErrors.WithLabelValues(export, "unknown", "EINVAL")), 1},
+		{"in flight", testutil.ToFloat64(metrics.RequestsInFlight.WithLabelValues(export)), 0},
+		{"connections", testutil.ToFloat64(metrics.Connections.WithLabelValues(export)), 0},
+		{"connections total", testutil.ToFloat64(metrics.ConnectionsTotal.WithLabelValues(export)), 1},
+	}
+	for _, test := range tests {
+		if test.metric != test.want {
+			t.Errorf("%s is %v, expected %v", test.name, test.metric, test.want)
+		}
+	}
+}
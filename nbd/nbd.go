@@ -2,35 +2,40 @@ package nbd
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"sync"
 	"syscall"
-)
 
-// TODO: flag for device index
-type Device struct {
-	deviceIndex uint8
-}
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
 
 // operation is a ioctl operation to manage the network block device
 type operation uintptr
 
 const (
-	nbd_SET_SOCK   operation = (0xab<<8 | 0)
-	nbd_SET_SIZE   operation = (0xab<<8 | 2)
-	nbd_DO_IT      operation = (0xab<<8 | 3)
-	nbd_CLEAR_SOCK operation = (0xab<<8 | 4)
-	nbd_CLEAR_QUE  operation = (0xab<<8 | 5)
-	nbd_DISCONNECT operation = (0xab<<8 | 8)
-	nbd_SET_FLAGS  operation = (0xab<<8 | 10)
+	nbd_SET_SOCK    operation = (0xab<<8 | 0)
+	nbd_SET_BLKSIZE operation = (0xab<<8 | 1)
+	nbd_SET_SIZE    operation = (0xab<<8 | 2)
+	nbd_DO_IT       operation = (0xab<<8 | 3)
+	nbd_CLEAR_SOCK  operation = (0xab<<8 | 4)
+	nbd_CLEAR_QUE   operation = (0xab<<8 | 5)
+	nbd_DISCONNECT  operation = (0xab<<8 | 8)
+	nbd_SET_TIMEOUT operation = (0xab<<8 | 9)
+	nbd_SET_FLAGS   operation = (0xab<<8 | 10)
 )
 
-func NewDomainSocketClient(ctx context.Context, deviceName string, domainSockets chan<- uintptr) error {
+// NewDomainSocketClient attaches the device to the export served by NewDomainSocketServer,
+// there is no negotiation so the export details are handed straight to the kernel
+func NewDomainSocketClient(ctx context.Context, deviceName string, export *Export, domainSockets chan<- uintptr, opts ClientOptions) error {
+	size, err := export.Storage.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to determine size of storage: %w", err)
+	}
+
 	// the socketPair is a pair of anonymous connected unix domain socket.
 	// one goes to the kernel, the other this process
 	fmt.Println("opening UNIX domain sockets for client and server")
@@ -51,55 +56,139 @@ func NewDomainSocketClient(ctx context.Context, deviceName string, domainSockets
 	domainSockets <- uintptr(socketPair[1])
 	close(domainSockets)
 
-	return Client(ctx, deviceName, 10*1024*1024, 0, uintptr(socketPair[0]))
+	config := DeviceConfig{
+		Size:      size,
+		BlockSize: kernelBlockSize(export.Storage.Capabilities().BlockSizes),
+		Flags:     exportFlags(export),
+		Backend:   "disk8s:" + export.Name,
+	}
+	opts.Queue = opts.Queue.limit(export.Storage.Capabilities().BlockSizes.Maximum)
+	return attach(ctx, deviceName, config, uintptr(socketPair[0]), opts)
 }
 
-func NewTcpClient(ctx context.Context, deviceName string, port int) error {
-	err := withTcpConn(port, func(c *net.TCPConn) error {
-		f, err := c.File()
-		if err != nil {
-			return err
-		}
-		diskSize, flags, err := readGreeting(f)
+// NewTcpClient attaches the device to the server on the port, the session is encrypted
+// with NBD_OPT_STARTTLS when tlsConfig is set
+func NewTcpClient(ctx context.Context, deviceName string, port int, tlsConfig *tls.Config, opts ClientOptions) error {
+	target := Target{Network: "tcp", Address: fmt.Sprintf("localhost:%d", port), TLS: tlsConfig != nil}
+	return NewClient(ctx, deviceName, target, tlsConfig, opts)
+}
+
+// NewClient attaches the device to the export of the target, an empty deviceName lets the
+// kernel pick a free device, a lost connection is redialed
+func NewClient(ctx context.Context, deviceName string, target Target, tlsConfig *tls.Config, opts ClientOptions) error {
+	tlsConfig = targetTLSConfig(target, tlsConfig)
+	dial := func() (*kernelConn, error) {
+		return dialKernelConn(target, tlsConfig)
+	}
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	opts.Queue = opts.Queue.limit(conn.maxRequest)
+	return supervise(ctx, deviceName, conn, dial, opts)
+}
+
+// targetTLSConfig verifies the server against the host of the target, with the system
+// roots unless a config was given, and there is no TLS when the target does not ask for it
+func targetTLSConfig(target Target, tlsConfig *tls.Config) *tls.Config {
+	if !target.TLS {
+		return nil
+	}
+	if tlsConfig == nil {
+		return &tls.Config{ServerName: target.Host(), MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = target.Host()
+	}
+	return tlsConfig
+}
+
+// dialKernelConn negotiates a connection with the server for the kernel to use
+func dialKernelConn(target Target, tlsConfig *tls.Config) (*kernelConn, error) {
+	fmt.Println("opening connection to", target)
+	c, err := net.Dial(target.Network, target.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, details, err := clientNegotiate(c, target.ExportName, tlsConfig)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	config := DeviceConfig{
+		Size:      details.size,
+		BlockSize: kernelBlockSize(details.blockSizes),
+		Flags:     details.flags,
+		Backend:   target.String(),
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		socket, err := kernelRelay(tlsConn)
 		if err != nil {
-			return err
+			tlsConn.Close()
+			return nil, err
 		}
-		defer f.Close()
-		return Client(ctx, deviceName, diskSize, flags, f.Fd())
-	})
-	return err
+		return &kernelConn{socket: socket, config: config, maxRequest: details.blockSizes.Maximum, close: func() {
+			syscall.Close(int(socket))
+			tlsConn.Close()
+		}}, nil
+	}
+	// the kernel gets a duplicate of the descriptor
+	filer, ok := c.(interface{ File() (*os.File, error) })
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("cannot hand a %s connection to the kernel", target.Network)
+	}
+	f, err := filer.File()
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &kernelConn{socket: f.Fd(), config: config, maxRequest: details.blockSizes.Maximum, close: func() { f.Close() }}, nil
 }
 
-func readGreeting(in io.Reader) (diskSize uint64, flags uint32, err error) {
-	greeting := make([]byte, 152)
-	n, err := in.Read(greeting)
-	if err != nil || n != 152 {
-		return 0, 0, fmt.Errorf("Client Failed to read greeting during negotiation, read %d/152 bytes and error: %w", n, err)
+// kernelRelay returns one end of a socket pair for the kernel and relays the other end
+// through conn, for TLS sessions which the kernel cannot handle itself
+func kernelRelay(conn net.Conn) (uintptr, error) {
+	socketPair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create socketpair for relay: %w", err)
 	}
+	relay(os.NewFile(uintptr(socketPair[1]), "relay"), conn)
+	return uintptr(socketPair[0]), nil
+}
 
-	if binary.BigEndian.Uint64([]byte("NBDMAGIC")) != binary.BigEndian.Uint64(greeting[0:8]) {
-		return 0, 0, fmt.Errorf("missing NBDMAGIC from server greeting")
+// attach has the kernel serve the device over the socket until the context is done,
+// there is no reconnecting a socket that was handed over
+func attach(ctx context.Context, deviceName string, config DeviceConfig, socket uintptr, opts ClientOptions) error {
+	return supervise(ctx, deviceName, &kernelConn{socket: socket, config: config, close: func() {}}, nil, opts)
+}
+
+// kernelBlockSize picks the block size of the device from the minimum block size of the
+// export rounded up to a power of two, the kernel only takes 512 up to the page size, the
+// preferred size is only a hint for i/o so it does not grow the sectors, 0 leaves the default
+func kernelBlockSize(sizes store.BlockSizes) uint32 {
+	if sizes.Minimum == 0 {
+		return 0
+	}
+	blockSize, pageSize := uint32(512), uint32(os.Getpagesize())
+	for blockSize < sizes.Minimum && blockSize < pageSize {
+		blockSize *= 2
 	}
-	if nbd_CLISERV_MAGIC != binary.BigEndian.Uint64(greeting[8:16]) {
-		return 0, 0, fmt.Errorf("missing CLISERV magic from server greeting")
+	if sizes.Minimum > blockSize {
+		fmt.Printf("device block size %d cannot satisfy the minimum block size %d of the export\n", blockSize, sizes.Minimum)
 	}
-	diskSize = binary.BigEndian.Uint64(greeting[16:24])
-	flags = binary.BigEndian.Uint32(greeting[24:48])
-	return
+	return blockSize
 }
 
-func withTcpConn(port int, f func(*net.TCPConn) error) error {
-	fmt.Println("opening TCP connection to server")
-	conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{Port: port})
+// Client attaches the device to the socket with ioctls and blocks until it is disconnected,
+// a zero block size or timeout keeps the kernel default, there is no dead connection timeout
+func Client(ctx context.Context, deviceName string, config DeviceConfig, opts ClientOptions, socket uintptr) error {
+	device, err := ParseDevice(deviceName)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	err = f(conn)
-	return err
-}
 
-func Client(ctx context.Context, deviceName string, diskSize uint64, flags uint32, socket uintptr) error {
 	// the device is like /dev/nbd0 and is used by the user as a block device
 	// this code will interact with it as a device with ioctl
 	fmt.Println("Starting nbd device", deviceName, "...")
@@ -135,17 +224,35 @@ func Client(ctx context.Context, deviceName string, diskSize uint64, flags uint3
 	_ = devDeviceFd.ioctl(nbd_CLEAR_QUE, 0)
 	_ = devDeviceFd.ioctl(nbd_CLEAR_SOCK, 0)
 
+	// the block size goes first, the kernel checks the size against it
+	if config.BlockSize != 0 {
+		fmt.Println("Setting block size to", config.BlockSize)
+		if err := devDeviceFd.ioctl(nbd_SET_BLKSIZE, uintptr(config.BlockSize)); err != nil {
+			fmt.Println("failed to set the block size, keeping the default:", err)
+		}
+	}
+
 	// one option would have been to send NBD_BLOCKSIZE and NBD_SIZE_BLOCKS, but we can also
 	// just do NBD_SET_SIZE with bytes
-	fmt.Printf("Setting disk size to %dMB\n", diskSize/1024/1024)
-	_ = devDeviceFd.ioctl(nbd_SET_SIZE, uintptr(diskSize))
+	fmt.Printf("Setting disk size to %dMB\n", config.Size/1024/1024)
+	_ = devDeviceFd.ioctl(nbd_SET_SIZE, uintptr(config.Size))
+
+	if config.Timeout != 0 {
+		fmt.Println("Setting request timeout to", config.Timeout)
+		if err := devDeviceFd.ioctl(nbd_SET_TIMEOUT, uintptr(seconds(config.Timeout))); err != nil {
+			fmt.Println("failed to set the timeout, keeping the default:", err)
+		}
+	}
 
 	if err := devDeviceFd.ioctl(nbd_SET_SOCK, uintptr(socket)); err != nil {
 		return fmt.Errorf("failed to give the kernel its UNIX domain socket: %w", err)
 	}
 
 	fmt.Println("Send Flags")
-	devDeviceFd.ioctl(nbd_SET_FLAGS, uintptr(flags))
+	devDeviceFd.ioctl(nbd_SET_FLAGS, uintptr(config.Flags))
+
+	// the queue is there before the device starts, so it can be tuned now
+	opts.Queue.apply(device)
 
 	// handle external shutdown or internal shutdown
 	var cancel func()
@@ -154,6 +261,7 @@ func Client(ctx context.Context, deviceName string, diskSize uint64, flags uint3
 	go func() {
 		<-ctx.Done()
 		fmt.Println("begin gracefully shutting down device client...")
+		opts.drain(device, devDeviceFile)
 		shutdownDevice()
 	}()
 
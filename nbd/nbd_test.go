@@ -0,0 +1,30 @@
+package nbd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+func TestKernelBlockSize(t *testing.T) {
+	pageSize := uint32(os.Getpagesize())
+	tests := []struct {
+		sizes store.BlockSizes
+		want  uint32
+	}{
+		{store.BlockSizes{}, 0},
+		{store.BlockSizes{Minimum: 1, Preferred: 4096, Maximum: 32 << 20}, 512},
+		{store.BlockSizes{Minimum: 1, Preferred: 1 << 20, Maximum: 2 << 20}, 512},
+		{store.BlockSizes{Minimum: 512, Preferred: 4096}, 512},
+		{store.BlockSizes{Minimum: 513}, 1024},
+		{store.BlockSizes{Minimum: 4096}, 4096},
+		{store.BlockSizes{Minimum: pageSize}, pageSize},
+		{store.BlockSizes{Minimum: 2 * pageSize}, pageSize},
+	}
+	for _, test := range tests {
+		if got := kernelBlockSize(test.sizes); got != test.want {
+			t.Errorf("kernelBlockSize(%+v) = %d, expected %d", test.sizes, got, test.want)
+		}
+	}
+}
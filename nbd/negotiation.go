@@ -0,0 +1,450 @@
+package nbd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// fixed newstyle negotiation, see "Newstyle negotiation" in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+
+const (
+	nbd_IHAVEOPT_MAGIC  uint64 = 0x49484156454F5054 // "IHAVEOPT"
+	nbd_OPT_REPLY_MAGIC uint64 = 0x0003e889045565a9
+
+	// server handshake flags
+	nbd_FLAG_FIXED_NEWSTYLE uint16 = 1 << 0
+	nbd_FLAG_NO_ZEROES      uint16 = 1 << 1
+
+	// client flags
+	nbd_FLAG_C_FIXED_NEWSTYLE uint32 = 1 << 0
+	nbd_FLAG_C_NO_ZEROES      uint32 = 1 << 1
+
+	// transmission flags
+	nbd_FLAG_HAS_FLAGS         uint16 = 1 << 0
+	nbd_FLAG_READ_ONLY         uint16 = 1 << 1
+	nbd_FLAG_SEND_FLUSH        uint16 = 1 << 2
+	nbd_FLAG_SEND_FUA          uint16 = 1 << 3
+	nbd_FLAG_SEND_TRIM         uint16 = 1 << 5
+	nbd_FLAG_SEND_WRITE_ZEROES uint16 = 1 << 6
+	nbd_FLAG_CAN_MULTI_CONN    uint16 = 1 << 8
+
+	// the largest option payload we are willing to read during negotiation
+	maxOptionLength = 64 * 1024
+)
+
+// option is requested by the client during the negotiation phase
+type option uint32
+
+const (
+	nbd_OPT_EXPORT_NAME option = 1
+	nbd_OPT_ABORT       option = 2
+	nbd_OPT_LIST        option = 3
+	nbd_OPT_STARTTLS    option = 5
+	nbd_OPT_INFO        option = 6
+	nbd_OPT_GO          option = 7
+
+	nbd_OPT_STRUCTURED_REPLY  option = 8
+	nbd_OPT_LIST_META_CONTEXT option = 9
+	nbd_OPT_SET_META_CONTEXT  option = 10
+	nbd_OPT_EXTENDED_HEADERS  option = 11
+)
+
+// optionReply is the type of the server's response to an option
+type optionReply uint32
+
+const (
+	nbd_REP_ACK    optionReply = 1
+	nbd_REP_SERVER optionReply = 2
+	nbd_REP_INFO   optionReply = 3
+
+	nbd_REP_META_CONTEXT optionReply = 4
+
+	nbd_REP_FLAG_ERROR   optionReply = 1 << 31
+	nbd_REP_ERR_UNSUP    optionReply = 1 | nbd_REP_FLAG_ERROR
+	nbd_REP_ERR_INVALID  optionReply = 3 | nbd_REP_FLAG_ERROR
+	nbd_REP_ERR_TLS_REQD optionReply = 5 | nbd_REP_FLAG_ERROR
+	nbd_REP_ERR_UNKNOWN  optionReply = 6 | nbd_REP_FLAG_ERROR
+
+	nbd_REP_ERR_BLOCK_SIZE_REQD optionReply = 8 | nbd_REP_FLAG_ERROR
+)
+
+// info types sent in an nbd_REP_INFO reply to nbd_OPT_INFO and nbd_OPT_GO
+const (
+	nbd_INFO_EXPORT     uint16 = 0
+	nbd_INFO_BLOCK_SIZE uint16 = 3
+)
+
+// errAbort is returned from negotiation when the client ends the session without
+// entering transmission
+var errAbort = errors.New("client aborted negotiation")
+
+// handshake is the server side of negotiation on a single connection, it also keeps
+// track of what was agreed on for the transmission phase
+type handshake struct {
+	io.ReadWriter
+	noZeroes          bool
+	tlsStarted        bool
+	structuredReplies bool
+	// extendedHeaders imply structured replies
+	extendedHeaders bool
+	// allocationExport is the export base:allocation was selected for, if any
+	allocationExport *Export
+}
+
+func (h *handshake) writeOptionReply(opt option, replyType optionReply, data []byte) error {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint64(header[0:8], nbd_OPT_REPLY_MAGIC)
+	binary.BigEndian.PutUint32(header[8:12], uint32(opt))
+	binary.BigEndian.PutUint32(header[12:16], uint32(replyType))
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(data)))
+	if _, err := h.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to send reply to option %d: %w", opt, err)
+	}
+	return nil
+}
+
+func (h *handshake) writeOptionError(opt option, replyType optionReply, message string) error {
+	return h.writeOptionReply(opt, replyType, []byte(message))
+}
+
+// readOption reads the next option haggled by the client
+func (h *handshake) readOption() (option, []byte, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(h, header); err != nil {
+		return 0, nil, fmt.Errorf("failed to read option from client: %w", err)
+	}
+	if binary.BigEndian.Uint64(header[0:8]) != nbd_IHAVEOPT_MAGIC {
+		return 0, nil, fmt.Errorf("missing IHAVEOPT magic in option from client")
+	}
+	opt := option(binary.BigEndian.Uint32(header[8:12]))
+	length := binary.BigEndian.Uint32(header[12:16])
+	if length > maxOptionLength {
+		return opt, nil, fmt.Errorf("option %d from client has length %d over the limit of %d", opt, length, maxOptionLength)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(h, data); err != nil {
+		return opt, nil, fmt.Errorf("failed to read data for option %d: %w", opt, err)
+	}
+	return opt, data, nil
+}
+
+// exportFlags are the transmission flags advertised for an export, from what its
+// storage can do
+func exportFlags(export *Export) uint16 {
+	caps := export.Storage.Capabilities()
+	flags := nbd_FLAG_HAS_FLAGS
+	if export.ReadOnly || caps.ReadOnly {
+		flags |= nbd_FLAG_READ_ONLY
+	} else {
+		if caps.Trim {
+			flags |= nbd_FLAG_SEND_TRIM
+		}
+		if caps.WriteZeroes {
+			flags |= nbd_FLAG_SEND_WRITE_ZEROES
+		}
+	}
+	if caps.Flush {
+		flags |= nbd_FLAG_SEND_FLUSH
+	}
+	if caps.FUA {
+		flags |= nbd_FLAG_SEND_FUA
+	}
+	// clients can only open several connections to the export when they all see the
+	// same data, which is trivially true when nothing is written
+	if caps.MultiConn || flags&nbd_FLAG_READ_ONLY != 0 {
+		flags |= nbd_FLAG_CAN_MULTI_CONN
+	}
+	return flags
+}
+
+// serviceSocket sets up the transmission phase for the export with what was negotiated
+func (h *handshake) serviceSocket(export *Export, size uint64) *serviceSocket {
+	fmt.Printf("serving export %q\n", export.Name)
+	return &serviceSocket{
+		ReadWriter:        h.ReadWriter,
+		Storage:           export.Storage,
+		export:            export.Name,
+		size:              size,
+		flags:             exportFlags(export),
+		structuredReplies: h.structuredReplies,
+		extendedHeaders:   h.extendedHeaders,
+		// meta contexts only apply to the export they were selected for
+		baseAllocation: h.allocationExport == export,
+	}
+}
+
+// metaContext lists the meta contexts matching the client's queries, and selects them
+// for transmission when setting
+func (h *handshake) metaContext(opt option, data []byte, exports *Exports) error {
+	if opt == nbd_OPT_SET_META_CONTEXT {
+		// a new set replaces any contexts selected before
+		h.allocationExport = nil
+		if !h.structuredReplies {
+			return h.writeOptionError(opt, nbd_REP_ERR_INVALID, "meta contexts require structured replies")
+		}
+	}
+	name, queries, err := parseMetaContextRequest(data)
+	if err != nil {
+		return h.writeOptionError(opt, nbd_REP_ERR_INVALID, err.Error())
+	}
+	export, ok := exports.Get(name)
+	if !ok {
+		return h.writeOptionError(opt, nbd_REP_ERR_UNKNOWN, fmt.Sprintf("unknown export %q", name))
+	}
+	if matchesBaseAllocation(queries, opt == nbd_OPT_LIST_META_CONTEXT) {
+		if opt == nbd_OPT_SET_META_CONTEXT {
+			h.allocationExport = export
+		}
+		if err := h.writeOptionReply(opt, nbd_REP_META_CONTEXT, metaContextReply(baseAllocationID, baseAllocation)); err != nil {
+			return err
+		}
+	}
+	return h.writeOptionReply(opt, nbd_REP_ACK, nil)
+}
+
+// exportInfo is the nbd_INFO_EXPORT payload, the size and transmission flags of the export
+func exportInfo(size uint64, flags uint16) []byte {
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info[0:2], nbd_INFO_EXPORT)
+	binary.BigEndian.PutUint64(info[2:10], size)
+	binary.BigEndian.PutUint16(info[10:12], flags)
+	return info
+}
+
+// blockSizeInfo tells the client the block sizes of the export
+func blockSizeInfo(sizes store.BlockSizes) []byte {
+	info := make([]byte, 14)
+	binary.BigEndian.PutUint16(info[0:2], nbd_INFO_BLOCK_SIZE)
+	binary.BigEndian.PutUint32(info[2:6], sizes.Minimum)
+	binary.BigEndian.PutUint32(info[6:10], sizes.Preferred)
+	binary.BigEndian.PutUint32(info[10:14], sizes.Maximum)
+	return info
+}
+
+// parseInfoRequest parses the payload of nbd_OPT_INFO and nbd_OPT_GO into the
+// export name and the information types requested by the client
+func parseInfoRequest(data []byte) (name string, infos []uint16, err error) {
+	if len(data) < 6 {
+		return "", nil, fmt.Errorf("option payload of %d bytes is too short", len(data))
+	}
+	nameLen := binary.BigEndian.Uint32(data[0:4])
+	if uint64(nameLen)+6 > uint64(len(data)) {
+		return "", nil, fmt.Errorf("export name length %d overruns option payload of %d bytes", nameLen, len(data))
+	}
+	name = string(data[4 : 4+nameLen])
+	rest := data[4+nameLen:]
+	numInfos := int(binary.BigEndian.Uint16(rest[0:2]))
+	if len(rest) != 2+2*numInfos {
+		return "", nil, fmt.Errorf("expected %d information requests in %d bytes", numInfos, len(rest)-2)
+	}
+	for i := 0; i < numInfos; i++ {
+		infos = append(infos, binary.BigEndian.Uint16(rest[2+2*i:4+2*i]))
+	}
+	return name, infos, nil
+}
+
+// negotiate runs the server side of the fixed newstyle handshake, and once the client has
+// chosen an export, returns the socket set up for the transmission phase
+func negotiate(ctx context.Context, conn net.Conn, exports *Exports, opts ServerOptions) (*serviceSocket, error) {
+	greeting := make([]byte, 18)
+	copy(greeting[0:8], []byte("NBDMAGIC"))
+	binary.BigEndian.PutUint64(greeting[8:16], nbd_IHAVEOPT_MAGIC)
+	binary.BigEndian.PutUint16(greeting[16:18], nbd_FLAG_FIXED_NEWSTYLE|nbd_FLAG_NO_ZEROES)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, fmt.Errorf("failed to write greeting to client during negotiation: %w", err)
+	}
+
+	clientFlagBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, clientFlagBytes); err != nil {
+		return nil, fmt.Errorf("failed to read client flags during negotiation: %w", err)
+	}
+	clientFlags := binary.BigEndian.Uint32(clientFlagBytes)
+	if clientFlags&^(nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES) != 0 {
+		return nil, fmt.Errorf("client sent unknown flags %#x during negotiation", clientFlags)
+	}
+	fixedNewstyle := clientFlags&nbd_FLAG_C_FIXED_NEWSTYLE != 0
+	h := handshake{ReadWriter: conn, noZeroes: clientFlags&nbd_FLAG_C_NO_ZEROES != 0}
+
+	for {
+		opt, data, err := h.readOption()
+		if err != nil {
+			return nil, err
+		}
+		if opts.TLSRequired && !h.tlsStarted && opt != nbd_OPT_STARTTLS && opt != nbd_OPT_ABORT {
+			if opt == nbd_OPT_EXPORT_NAME {
+				return nil, fmt.Errorf("client selected an export without starting TLS")
+			}
+			if err := h.writeOptionError(opt, nbd_REP_ERR_TLS_REQD, "TLS is required"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch opt {
+		case nbd_OPT_EXPORT_NAME:
+			export, ok := exports.Get(string(data))
+			if !ok {
+				// there is no way to refuse nbd_OPT_EXPORT_NAME other than hanging up
+				return nil, fmt.Errorf("client selected unknown export %q", data)
+			}
+			size, err := export.Storage.Size(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to determine size of storage for export %q: %w", export.Name, err)
+			}
+			reply := make([]byte, 10, 134)
+			binary.BigEndian.PutUint64(reply[0:8], size)
+			binary.BigEndian.PutUint16(reply[8:10], exportFlags(export))
+			if !h.noZeroes {
+				reply = reply[:134]
+			}
+			if _, err := h.Write(reply); err != nil {
+				return nil, fmt.Errorf("failed to write export details to client: %w", err)
+			}
+			return h.serviceSocket(export, size), nil
+		case nbd_OPT_INFO, nbd_OPT_GO:
+			name, infos, err := parseInfoRequest(data)
+			if err != nil {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, err.Error()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			export, ok := exports.Get(name)
+			if !ok {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_UNKNOWN, fmt.Sprintf("unknown export %q", name)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			size, err := export.Storage.Size(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to determine size of storage for export %q: %w", export.Name, err)
+			}
+			blockSizes := export.Storage.Capabilities().BlockSizes
+			blockSizesRequested := false
+			for _, info := range infos {
+				blockSizesRequested = blockSizesRequested || info == nbd_INFO_BLOCK_SIZE
+			}
+			if opt == nbd_OPT_GO && !blockSizesRequested && blockSizes.Minimum > 1 {
+				// the client would not know to align its requests
+				message := fmt.Sprintf("export %q needs requests aligned to %d bytes", export.Name, blockSizes.Minimum)
+				if err := h.writeOptionError(opt, nbd_REP_ERR_BLOCK_SIZE_REQD, message); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := h.writeOptionReply(opt, nbd_REP_INFO, exportInfo(size, exportFlags(export))); err != nil {
+				return nil, err
+			}
+			if blockSizesRequested {
+				if err := h.writeOptionReply(opt, nbd_REP_INFO, blockSizeInfo(blockSizes)); err != nil {
+					return nil, err
+				}
+			}
+			if err := h.writeOptionReply(opt, nbd_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+			if opt == nbd_OPT_GO {
+				ss := h.serviceSocket(export, size)
+				if blockSizesRequested {
+					// the client agreed to keep to the block sizes, so it is held to them
+					ss.blockSizes = blockSizes
+				}
+				return ss, nil
+			}
+		case nbd_OPT_LIST:
+			if len(data) != 0 {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, "list does not take any data"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, name := range exports.Names() {
+				entry := make([]byte, 4+len(name))
+				binary.BigEndian.PutUint32(entry[0:4], uint32(len(name)))
+				copy(entry[4:], name)
+				if err := h.writeOptionReply(opt, nbd_REP_SERVER, entry); err != nil {
+					return nil, err
+				}
+			}
+			if err := h.writeOptionReply(opt, nbd_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+		case nbd_OPT_STARTTLS:
+			if opts.TLS == nil {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_UNSUP, "TLS is not configured"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if h.tlsStarted || len(data) != 0 {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, "TLS already started or unexpected data"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := h.writeOptionReply(opt, nbd_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Server(conn, opts.TLS)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return nil, fmt.Errorf("TLS handshake with client failed: %w", err)
+			}
+			// nothing negotiated in the clear carries over to the TLS session
+			h = handshake{ReadWriter: tlsConn, noZeroes: h.noZeroes, tlsStarted: true}
+		case nbd_OPT_STRUCTURED_REPLY:
+			if len(data) != 0 {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, "structured reply does not take any data"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if h.extendedHeaders {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, "extended headers are already negotiated"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			h.structuredReplies = true
+			if err := h.writeOptionReply(opt, nbd_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+		case nbd_OPT_EXTENDED_HEADERS:
+			if len(data) != 0 || h.extendedHeaders {
+				if err := h.writeOptionError(opt, nbd_REP_ERR_INVALID, "extended headers do not take any data and are negotiated once"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			h.extendedHeaders = true
+			h.structuredReplies = true
+			// the block status replies change shape, so meta contexts have to be selected again
+			h.allocationExport = nil
+			if err := h.writeOptionReply(opt, nbd_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+		case nbd_OPT_LIST_META_CONTEXT, nbd_OPT_SET_META_CONTEXT:
+			if err := h.metaContext(opt, data, exports); err != nil {
+				return nil, err
+			}
+		case nbd_OPT_ABORT:
+			// the client may already have hung up, so the acknowledgement is best effort
+			_ = h.writeOptionReply(opt, nbd_REP_ACK, nil)
+			return nil, errAbort
+		default:
+			if !fixedNewstyle {
+				return nil, fmt.Errorf("unsupported option %d from a client without fixed newstyle", opt)
+			}
+			if err := h.writeOptionError(opt, nbd_REP_ERR_UNSUP, fmt.Sprintf("option %d is not supported", opt)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
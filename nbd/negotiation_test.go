@@ -0,0 +1,384 @@
+package nbd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// testServer serves the exports on a loopback listener until the test ends
+func testServer(t *testing.T, exports *Exports, opts ServerOptions) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = serve(ctx, listener, exports, opts)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// testTLSConfigs has a self signed certificate for localhost, and a client that trusts it
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ServerTLSConfig(certFile, keyFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = ClientTLSConfig(certFile, "", "", "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// readSimpleReply reads a simple reply and checks it answers the handle without error
+func readSimpleReply(t *testing.T, r io.Reader, handle uint64) {
+	t.Helper()
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if magic := binary.BigEndian.Uint32(reply[0:4]); magic != nbd_REPLY_MAGIC {
+		t.Fatalf("reply has magic %#x", magic)
+	}
+	if code := binary.BigEndian.Uint32(reply[4:8]); code != 0 {
+		t.Fatalf("reply has error %d", code)
+	}
+	if got := binary.BigEndian.Uint64(reply[8:16]); got != handle {
+		t.Fatalf("reply has handle %d, expected %d", got, handle)
+	}
+}
+
+func TestExportNameAfterStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	exports := NewExports()
+	if err := exports.Add("disk", store.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+	defer exports.Release()
+	addr := testServer(t, exports, ServerOptions{TLS: serverTLS, TLSRequired: true})
+
+	netConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	_ = netConn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, noZeroes, err := clientHandshake(netConn, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Fatalf("handshake left a %T instead of a TLS session", conn)
+	}
+	// the export details have to come over the TLS session rather than the raw socket
+	details, err := clientExportName(conn, "disk", noZeroes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.size == 0 {
+		t.Fatal("export has a size of 0")
+	}
+
+	data := []byte("over tls")
+	if _, err := conn.Write(append(clientRequest(nbd_CMD_WRITE, 0, 1, 512, uint32(len(data))), data...)); err != nil {
+		t.Fatal(err)
+	}
+	readSimpleReply(t, conn, 1)
+	if _, err := conn.Write(clientRequest(nbd_CMD_READ, 0, 2, 512, uint32(len(data)))); err != nil {
+		t.Fatal(err)
+	}
+	readSimpleReply(t, conn, 2)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("read %q, expected %q", got, data)
+	}
+	if _, err := conn.Write(clientRequest(nbd_CMD_DISC, 0, 3, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// alignedStorage needs requests aligned to 512 bytes
+type alignedStorage struct {
+	*fuzzStorage
+}
+
+func (s alignedStorage) Capabilities() store.Capabilities {
+	caps := s.fuzzStorage.Capabilities()
+	caps.BlockSizes.Minimum = 512
+	return caps
+}
+
+// testNegotiation serves a default export, "disk", and "aligned" which needs block sizes,
+// and connects with the client flags, leaving the connection ready for options
+func testNegotiation(t *testing.T, clientFlags uint32) net.Conn {
+	t.Helper()
+	exports := NewExports()
+	for _, export := range []Export{
+		{Name: "", Storage: &fuzzStorage{data: make([]byte, fuzzSize)}},
+		{Name: "disk", Storage: &fuzzStorage{data: make([]byte, fuzzSize)}},
+		{Name: "aligned", Storage: alignedStorage{&fuzzStorage{data: make([]byte, fuzzSize)}}},
+	} {
+		if err := exports.Add(export.Name, export.Storage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(exports.Release)
+	conn, err := net.Dial("tcp", testServer(t, exports, ServerOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	greeting := make([]byte, 18)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+	if string(greeting[0:8]) != "NBDMAGIC" || binary.BigEndian.Uint64(greeting[8:16]) != nbd_IHAVEOPT_MAGIC {
+		t.Fatalf("greeting % x", greeting)
+	}
+	if flags := binary.BigEndian.Uint16(greeting[16:18]); flags != nbd_FLAG_FIXED_NEWSTYLE|nbd_FLAG_NO_ZEROES {
+		t.Fatalf("server flags %#x", flags)
+	}
+	flags := make([]byte, 4)
+	binary.BigEndian.PutUint32(flags, clientFlags)
+	if _, err := conn.Write(flags); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// infoRequest is the payload of nbd_OPT_INFO and nbd_OPT_GO
+func infoRequest(name string, infos ...uint16) []byte {
+	data := make([]byte, 4+len(name)+2+2*len(infos))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(name)))
+	copy(data[4:], name)
+	binary.BigEndian.PutUint16(data[4+len(name):], uint16(len(infos)))
+	for i, info := range infos {
+		binary.BigEndian.PutUint16(data[6+len(name)+2*i:], info)
+	}
+	return data
+}
+
+// optionReplies sends the option and reads replies up to the first that is not
+// nbd_REP_INFO or nbd_REP_SERVER
+func optionReplies(t *testing.T, conn net.Conn, opt option, data []byte) ([]optionReply, [][]byte) {
+	t.Helper()
+	if err := writeOption(conn, opt, data); err != nil {
+		t.Fatal(err)
+	}
+	types, payloads := []optionReply{}, [][]byte{}
+	for {
+		replyType, payload, err := readOptionReply(conn, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types, payloads = append(types, replyType), append(payloads, payload)
+		if replyType != nbd_REP_INFO && replyType != nbd_REP_SERVER {
+			return types, payloads
+		}
+	}
+}
+
+func TestNegotiateList(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+	types, payloads := optionReplies(t, conn, nbd_OPT_LIST, nil)
+	names := []string{}
+	for i, replyType := range types[:len(types)-1] {
+		if replyType != nbd_REP_SERVER {
+			t.Fatalf("list reply %d has type %#x", i, uint32(replyType))
+		}
+		length := binary.BigEndian.Uint32(payloads[i][0:4])
+		names = append(names, string(payloads[i][4:4+length]))
+	}
+	if types[len(types)-1] != nbd_REP_ACK {
+		t.Fatalf("list ended with %#x", uint32(types[len(types)-1]))
+	}
+	if fmt.Sprint(names) != fmt.Sprint([]string{"", "disk", "aligned"}) {
+		t.Fatalf("listed %q", names)
+	}
+
+	// data with a list is invalid, and negotiation carries on
+	if types, _ := optionReplies(t, conn, nbd_OPT_LIST, []byte{0}); fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_INVALID}) {
+		t.Fatalf("list with data got %#x", types)
+	}
+}
+
+func TestNegotiateInfoAndGo(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+
+	// info describes the export and stays in negotiation
+	types, payloads := optionReplies(t, conn, nbd_OPT_INFO, infoRequest("disk", nbd_INFO_BLOCK_SIZE))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("info got %#x", types)
+	}
+	if size := binary.BigEndian.Uint64(payloads[0][2:10]); binary.BigEndian.Uint16(payloads[0][0:2]) != nbd_INFO_EXPORT || size != fuzzSize {
+		t.Fatalf("export info % x", payloads[0])
+	}
+	if binary.BigEndian.Uint16(payloads[1][0:2]) != nbd_INFO_BLOCK_SIZE || binary.BigEndian.Uint32(payloads[1][10:14]) != maxPayload {
+		t.Fatalf("block size info % x", payloads[1])
+	}
+
+	// block sizes were not asked for this time, so only the export info comes back
+	types, _ = optionReplies(t, conn, nbd_OPT_GO, infoRequest("disk"))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("go got %#x", types)
+	}
+	// go enters transmission
+	if _, err := conn.Write(clientRequest(nbd_CMD_READ, 0, 1, 0, 512)); err != nil {
+		t.Fatal(err)
+	}
+	readSimpleReply(t, conn, 1)
+}
+
+func TestNegotiateGoUnknownExport(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+	for _, opt := range []option{nbd_OPT_INFO, nbd_OPT_GO} {
+		types, _ := optionReplies(t, conn, opt, infoRequest("missing"))
+		if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_UNKNOWN}) {
+			t.Fatalf("option %d for an unknown export got %#x", opt, types)
+		}
+	}
+	// a malformed request is invalid rather than unknown
+	types, _ := optionReplies(t, conn, nbd_OPT_GO, []byte{0, 0, 0, 9, 'd'})
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_INVALID}) {
+		t.Fatalf("malformed go got %#x", types)
+	}
+	// an empty name is the default export
+	types, _ = optionReplies(t, conn, nbd_OPT_GO, infoRequest(""))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("go for the default export got %#x", types)
+	}
+}
+
+func TestNegotiateBlockSizeRequired(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+	types, _ := optionReplies(t, conn, nbd_OPT_GO, infoRequest("aligned"))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_BLOCK_SIZE_REQD}) {
+		t.Fatalf("go without block sizes got %#x", types)
+	}
+	// info only describes the export, so it is answered without block sizes
+	types, _ = optionReplies(t, conn, nbd_OPT_INFO, infoRequest("aligned"))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("info without block sizes got %#x", types)
+	}
+	types, payloads := optionReplies(t, conn, nbd_OPT_GO, infoRequest("aligned", nbd_INFO_BLOCK_SIZE))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("go with block sizes got %#x", types)
+	}
+	if minimum := binary.BigEndian.Uint32(payloads[1][2:6]); minimum != 512 {
+		t.Fatalf("minimum block size %d", minimum)
+	}
+}
+
+func TestNegotiateAbort(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+	types, _ := optionReplies(t, conn, nbd_OPT_ABORT, nil)
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ACK}) {
+		t.Fatalf("abort got %#x", types)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open after abort: %v", err)
+	}
+}
+
+func TestNegotiateUnknownOption(t *testing.T) {
+	conn := testNegotiation(t, nbd_FLAG_C_FIXED_NEWSTYLE|nbd_FLAG_C_NO_ZEROES)
+	types, _ := optionReplies(t, conn, option(99), []byte("ignored"))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_UNSUP}) {
+		t.Fatalf("unknown option got %#x", types)
+	}
+	// starting TLS is unsupported without a certificate
+	types, _ = optionReplies(t, conn, nbd_OPT_STARTTLS, nil)
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_ERR_UNSUP}) {
+		t.Fatalf("starttls without TLS got %#x", types)
+	}
+	// negotiation carries on after the errors
+	types, _ = optionReplies(t, conn, nbd_OPT_GO, infoRequest("disk"))
+	if fmt.Sprint(types) != fmt.Sprint([]optionReply{nbd_REP_INFO, nbd_REP_ACK}) {
+		t.Fatalf("go after errors got %#x", types)
+	}
+}
+
+func TestNegotiateWithoutFixedNewstyle(t *testing.T) {
+	// without fixed newstyle there are no error replies, the server can only hang up
+	conn := testNegotiation(t, 0)
+	if err := writeOption(conn, option(99), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open after an unknown option: %v", err)
+	}
+
+	// selecting an export still works, and without no zeroes the details are padded
+	conn = testNegotiation(t, 0)
+	details, err := clientExportName(conn, "disk", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.size != fuzzSize {
+		t.Fatalf("export size %d", details.size)
+	}
+	if _, err := conn.Write(clientRequest(nbd_CMD_READ, 0, 1, 0, 512)); err != nil {
+		t.Fatal(err)
+	}
+	readSimpleReply(t, conn, 1)
+}
@@ -0,0 +1,530 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// See include/uapi/linux/nbd-netlink.h for the generic netlink interface of the nbd module
+
+const (
+	nbd_GENL_FAMILY_NAME      = "nbd"
+	nbd_GENL_VERSION          = 1
+	nbd_GENL_MCAST_GROUP_NAME = "nbd_mc_group"
+)
+
+// netlinkCommand is a generic netlink command of the nbd family
+type netlinkCommand uint8
+
+const (
+	nbd_NL_CMD_CONNECT     netlinkCommand = 1
+	nbd_NL_CMD_DISCONNECT  netlinkCommand = 2
+	nbd_NL_CMD_RECONFIGURE netlinkCommand = 3
+	nbd_NL_CMD_LINK_DEAD   netlinkCommand = 4
+	nbd_NL_CMD_STATUS      netlinkCommand = 5
+)
+
+// netlinkAttr is the type of a netlink attribute, nested attributes reuse the small numbers
+type netlinkAttr uint16
+
+const (
+	nbd_ATTR_INDEX              netlinkAttr = 1
+	nbd_ATTR_SIZE_BYTES         netlinkAttr = 2
+	nbd_ATTR_BLOCK_SIZE_BYTES   netlinkAttr = 3
+	nbd_ATTR_TIMEOUT            netlinkAttr = 4
+	nbd_ATTR_SERVER_FLAGS       netlinkAttr = 5
+	nbd_ATTR_CLIENT_FLAGS       netlinkAttr = 6
+	nbd_ATTR_SOCKETS            netlinkAttr = 7
+	nbd_ATTR_DEAD_CONN_TIMEOUT  netlinkAttr = 8
+	nbd_ATTR_DEVICE_LIST        netlinkAttr = 9
+	nbd_ATTR_BACKEND_IDENTIFIER netlinkAttr = 10
+
+	// inside nbd_ATTR_SOCKETS
+	nbd_SOCK_ITEM netlinkAttr = 1
+	nbd_SOCK_FD   netlinkAttr = 1
+
+	// inside nbd_ATTR_DEVICE_LIST
+	nbd_DEVICE_ITEM      netlinkAttr = 1
+	nbd_DEVICE_INDEX     netlinkAttr = 1
+	nbd_DEVICE_CONNECTED netlinkAttr = 2
+)
+
+// sizeofGenlmsghdr is the command, version and reserved u16 in front of the attributes
+const sizeofGenlmsghdr = 4
+
+// errNoNetlink is returned when the kernel has no nbd generic netlink family,
+// either the module is not loaded or it predates netlink
+var errNoNetlink = errors.New("nbd generic netlink family is not available")
+
+// nativeEndian is the byte order of netlink headers and attributes
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Device is the kernel network block device /dev/nbd<Index>
+type Device struct {
+	Index uint32
+}
+
+// DeviceConfig is what the kernel needs to know to serve a device
+type DeviceConfig struct {
+	Size uint64
+	// BlockSize of 0 keeps the kernel default
+	BlockSize uint32
+	// Flags are the transmission flags of the export
+	Flags uint16
+	// Timeout of each request, 0 waits forever
+	Timeout time.Duration
+	// DeadConnTimeout is how long requests wait for a new socket after losing the last one
+	DeadConnTimeout time.Duration
+	// Backend identifies the export in /sys/block/nbdX/backend
+	Backend string
+}
+
+// DeviceStatus is whether the kernel has sockets configured for the device
+type DeviceStatus struct {
+	Device
+	Connected bool
+}
+
+func (d Device) Path() string {
+	return fmt.Sprintf("/dev/nbd%d", d.Index)
+}
+
+// deviceIndex parses the index out of a device like /dev/nbd3, an empty name is -1 so
+// the kernel picks the device
+func deviceIndex(deviceName string) (int, error) {
+	if deviceName == "" {
+		return -1, nil
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(deviceName), "nbd"))
+	if err != nil || index < 0 || !strings.HasPrefix(filepath.Base(deviceName), "nbd") {
+		return 0, fmt.Errorf("%q is not an nbd device like /dev/nbd0", deviceName)
+	}
+	return index, nil
+}
+
+// ConnectDevice has the kernel serve a device over the sockets, a negative index lets the
+// kernel pick a free device, the device stays connected after the sockets are closed here
+// until Disconnect
+func ConnectDevice(index int, config DeviceConfig, sockets ...uintptr) (Device, error) {
+	nl, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return Device{}, err
+	}
+	defer nl.Close()
+
+	attrs := attributes{}.u64(nbd_ATTR_SIZE_BYTES, config.Size).
+		u64(nbd_ATTR_SERVER_FLAGS, uint64(config.Flags))
+	if index >= 0 {
+		attrs = attrs.u32(nbd_ATTR_INDEX, uint32(index))
+	}
+	if config.BlockSize != 0 {
+		attrs = attrs.u64(nbd_ATTR_BLOCK_SIZE_BYTES, uint64(config.BlockSize))
+	}
+	if config.Timeout != 0 {
+		attrs = attrs.u64(nbd_ATTR_TIMEOUT, seconds(config.Timeout))
+	}
+	if config.DeadConnTimeout != 0 {
+		attrs = attrs.u64(nbd_ATTR_DEAD_CONN_TIMEOUT, seconds(config.DeadConnTimeout))
+	}
+	if config.Backend != "" {
+		attrs = attrs.str(nbd_ATTR_BACKEND_IDENTIFIER, config.Backend)
+	}
+	attrs = attrs.nested(nbd_ATTR_SOCKETS, socketItems(sockets))
+
+	replies, err := nl.execute(uint8(nbd_NL_CMD_CONNECT), nbd_GENL_VERSION, attrs)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to connect nbd device: %w", err)
+	}
+	for _, reply := range replies {
+		for _, a := range parseAttributes(reply) {
+			if netlinkAttr(a.typ) == nbd_ATTR_INDEX && len(a.data) >= 4 {
+				return Device{Index: nativeEndian.Uint32(a.data)}, nil
+			}
+		}
+	}
+	if index >= 0 {
+		return Device{Index: uint32(index)}, nil
+	}
+	return Device{}, errors.New("kernel connected an nbd device without saying which")
+}
+
+// Disconnect has the kernel send NBD_CMD_DISC and let go of the sockets
+func (d Device) Disconnect() error {
+	nl, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	_, err = nl.execute(uint8(nbd_NL_CMD_DISCONNECT), nbd_GENL_VERSION, attributes{}.u32(nbd_ATTR_INDEX, d.Index))
+	if err != nil {
+		return fmt.Errorf("failed to disconnect %s: %w", d.Path(), err)
+	}
+	return nil
+}
+
+// Reconfigure replaces the dead sockets of the device with new ones, requests stalled by
+// the dead connection timeout resume on them
+func (d Device) Reconfigure(config DeviceConfig, sockets ...uintptr) error {
+	nl, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	attrs := attributes{}.u32(nbd_ATTR_INDEX, d.Index)
+	if config.Timeout != 0 {
+		attrs = attrs.u64(nbd_ATTR_TIMEOUT, seconds(config.Timeout))
+	}
+	if config.DeadConnTimeout != 0 {
+		attrs = attrs.u64(nbd_ATTR_DEAD_CONN_TIMEOUT, seconds(config.DeadConnTimeout))
+	}
+	attrs = attrs.nested(nbd_ATTR_SOCKETS, socketItems(sockets))
+	if _, err := nl.execute(uint8(nbd_NL_CMD_RECONFIGURE), nbd_GENL_VERSION, attrs); err != nil {
+		return fmt.Errorf("failed to reconfigure %s: %w", d.Path(), err)
+	}
+	return nil
+}
+
+// Status asks the kernel whether the device is connected
+func (d Device) Status() (DeviceStatus, error) {
+	nl, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return DeviceStatus{}, err
+	}
+	defer nl.Close()
+	return d.status(nl)
+}
+
+// status asks over a socket the caller keeps open, for those checking on the device often
+func (d Device) status(nl *genetlink) (DeviceStatus, error) {
+	statuses, err := nl.deviceStatuses(attributes{}.u32(nbd_ATTR_INDEX, d.Index))
+	if err != nil {
+		return DeviceStatus{}, err
+	}
+	for _, s := range statuses {
+		if s.Index == d.Index {
+			return s, nil
+		}
+	}
+	return DeviceStatus{}, fmt.Errorf("kernel has no %s", d.Path())
+}
+
+// Devices lists every nbd device of the kernel
+func Devices() ([]DeviceStatus, error) {
+	nl, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Close()
+	return nl.deviceStatuses(nil)
+}
+
+func (nl *genetlink) deviceStatuses(attrs attributes) ([]DeviceStatus, error) {
+	replies, err := nl.execute(uint8(nbd_NL_CMD_STATUS), nbd_GENL_VERSION, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nbd device status: %w", err)
+	}
+	statuses := []DeviceStatus{}
+	for _, reply := range replies {
+		for _, list := range parseAttributes(reply) {
+			if netlinkAttr(list.typ) != nbd_ATTR_DEVICE_LIST {
+				continue
+			}
+			for _, item := range parseAttributes(list.data) {
+				if netlinkAttr(item.typ) != nbd_DEVICE_ITEM {
+					continue
+				}
+				status := DeviceStatus{}
+				for _, a := range parseAttributes(item.data) {
+					switch {
+					case netlinkAttr(a.typ) == nbd_DEVICE_INDEX && len(a.data) >= 4:
+						status.Index = nativeEndian.Uint32(a.data)
+					case netlinkAttr(a.typ) == nbd_DEVICE_CONNECTED && len(a.data) >= 1:
+						status.Connected = a.data[0] != 0
+					}
+				}
+				statuses = append(statuses, status)
+			}
+		}
+	}
+	return statuses, nil
+}
+
+func socketItems(sockets []uintptr) attributes {
+	items := attributes{}
+	for _, s := range sockets {
+		items = items.nested(nbd_SOCK_ITEM, attributes{}.u32(nbd_SOCK_FD, uint32(s)))
+	}
+	return items
+}
+
+// seconds rounds up so a short timeout is not turned into no timeout
+func seconds(d time.Duration) uint64 {
+	return uint64((d + time.Second - 1) / time.Second)
+}
+
+// attributes are netlink attributes in wire format, each padded to 4 bytes
+type attributes []byte
+
+func (a attributes) add(typ uint16, payload []byte) attributes {
+	header := make([]byte, unix.SizeofNlAttr)
+	nativeEndian.PutUint16(header[0:2], uint16(unix.SizeofNlAttr+len(payload)))
+	nativeEndian.PutUint16(header[2:4], typ)
+	a = append(append(a, header...), payload...)
+	for len(a)%unix.NLA_ALIGNTO != 0 {
+		a = append(a, 0)
+	}
+	return a
+}
+
+func (a attributes) u32(typ netlinkAttr, v uint32) attributes {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return a.add(uint16(typ), b)
+}
+
+func (a attributes) u64(typ netlinkAttr, v uint64) attributes {
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, v)
+	return a.add(uint16(typ), b)
+}
+
+func (a attributes) str(typ netlinkAttr, s string) attributes {
+	return a.add(uint16(typ), append([]byte(s), 0))
+}
+
+func (a attributes) nested(typ netlinkAttr, inner attributes) attributes {
+	return a.add(uint16(typ)|unix.NLA_F_NESTED, inner)
+}
+
+type attribute struct {
+	typ  uint16
+	data []byte
+}
+
+// parseAttributes splits attributes, stopping at the first malformed one
+func parseAttributes(b []byte) []attribute {
+	attrs := []attribute{}
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		if length < unix.SizeofNlAttr || length > len(b) {
+			break
+		}
+		attrs = append(attrs, attribute{
+			typ:  nativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			data: b[unix.SizeofNlAttr:length],
+		})
+		aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+// genetlink is a generic netlink socket talking to one family
+type genetlink struct {
+	fd     int
+	family uint16
+	seq    uint32
+	// groups are the multicast group ids of the family by name
+	groups map[string]uint32
+}
+
+// dialGenetlink opens a generic netlink socket and resolves the id of the family
+func dialGenetlink(family string) (*genetlink, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open generic netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind generic netlink socket: %w", err)
+	}
+	nl := &genetlink{fd: fd, family: unix.GENL_ID_CTRL, groups: map[string]uint32{}}
+
+	replies, err := nl.execute(unix.CTRL_CMD_GETFAMILY, 1, attributes{}.add(unix.CTRL_ATTR_FAMILY_NAME, append([]byte(family), 0)))
+	if errors.Is(err, syscall.ENOENT) {
+		nl.Close()
+		return nil, fmt.Errorf("%w: %v", errNoNetlink, err)
+	}
+	if err != nil {
+		nl.Close()
+		return nil, fmt.Errorf("failed to resolve generic netlink family %q: %w", family, err)
+	}
+	nl.family = 0
+	for _, reply := range replies {
+		for _, a := range parseAttributes(reply) {
+			switch {
+			case a.typ == unix.CTRL_ATTR_FAMILY_ID && len(a.data) >= 2:
+				nl.family = nativeEndian.Uint16(a.data)
+			case a.typ == unix.CTRL_ATTR_MCAST_GROUPS:
+				for _, group := range parseAttributes(a.data) {
+					name, id := "", uint32(0)
+					for _, ga := range parseAttributes(group.data) {
+						switch {
+						case ga.typ == unix.CTRL_ATTR_MCAST_GRP_NAME:
+							name = strings.TrimRight(string(ga.data), "\x00")
+						case ga.typ == unix.CTRL_ATTR_MCAST_GRP_ID && len(ga.data) >= 4:
+							id = nativeEndian.Uint32(ga.data)
+						}
+					}
+					nl.groups[name] = id
+				}
+			}
+		}
+	}
+	if nl.family == 0 {
+		nl.Close()
+		return nil, fmt.Errorf("%w: no id for family %q", errNoNetlink, family)
+	}
+	return nl, nil
+}
+
+func (nl *genetlink) Close() error {
+	return unix.Close(nl.fd)
+}
+
+// execute sends the command and collects the attributes of every reply until the kernel
+// acknowledges it
+func (nl *genetlink) execute(cmd uint8, version uint8, attrs attributes) ([][]byte, error) {
+	nl.seq++
+	length := unix.SizeofNlMsghdr + sizeofGenlmsghdr + len(attrs)
+	msg := make([]byte, unix.SizeofNlMsghdr+sizeofGenlmsghdr, length)
+	nativeEndian.PutUint32(msg[0:4], uint32(length))
+	nativeEndian.PutUint16(msg[4:6], nl.family)
+	nativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:12], nl.seq)
+	msg[16] = cmd
+	msg[17] = version
+	msg = append(msg, attrs...)
+	if err := unix.Sendto(nl.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	replies := [][]byte{}
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(nl.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := parseMessages(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.seq != nl.seq {
+				continue
+			}
+			switch m.typ {
+			case unix.NLMSG_ERROR:
+				if len(m.data) < 4 {
+					return nil, errors.New("truncated netlink error")
+				}
+				// an error of 0 is the acknowledgement
+				if code := int32(nativeEndian.Uint32(m.data[0:4])); code != 0 {
+					return nil, syscall.Errno(-code)
+				}
+				return replies, nil
+			case unix.NLMSG_DONE:
+				return replies, nil
+			case unix.NLMSG_NOOP:
+			default:
+				if len(m.data) >= sizeofGenlmsghdr {
+					replies = append(replies, append([]byte(nil), m.data[sizeofGenlmsghdr:]...))
+				}
+			}
+		}
+	}
+}
+
+// subscribe joins the multicast group of the family, with a timeout on receive so
+// the reader can give up waiting for notifications
+func (nl *genetlink) subscribe(group string, timeout time.Duration) error {
+	id, ok := nl.groups[group]
+	if !ok {
+		return fmt.Errorf("generic netlink family has no multicast group %q", group)
+	}
+	if err := unix.SetsockoptInt(nl.fd, unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, int(id)); err != nil {
+		return fmt.Errorf("failed to join multicast group %q: %w", group, err)
+	}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(nl.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set netlink receive timeout: %w", err)
+	}
+	return nil
+}
+
+// notification is a multicast message of the family
+type notification struct {
+	cmd   uint8
+	attrs []byte
+}
+
+// notifications waits for the multicast messages of a subscribed socket, none is
+// returned when the receive timeout passes
+func (nl *genetlink) notifications() ([]notification, error) {
+	buf := make([]byte, 64*1024)
+	n, _, err := unix.Recvfrom(nl.fd, buf, 0)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := parseMessages(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	notifications := []notification{}
+	for _, m := range msgs {
+		if m.typ == nl.family && len(m.data) >= sizeofGenlmsghdr {
+			notifications = append(notifications, notification{cmd: m.data[0], attrs: m.data[sizeofGenlmsghdr:]})
+		}
+	}
+	return notifications, nil
+}
+
+type netlinkMessage struct {
+	typ  uint16
+	seq  uint32
+	data []byte
+}
+
+// parseMessages splits a datagram from a netlink socket into its messages
+func parseMessages(b []byte) ([]netlinkMessage, error) {
+	msgs := []netlinkMessage{}
+	for len(b) >= unix.SizeofNlMsghdr {
+		msgLen := int(nativeEndian.Uint32(b[0:4]))
+		if msgLen < unix.SizeofNlMsghdr || msgLen > len(b) {
+			return nil, fmt.Errorf("malformed netlink message of %d bytes", msgLen)
+		}
+		msgs = append(msgs, netlinkMessage{
+			typ:  nativeEndian.Uint16(b[4:6]),
+			seq:  nativeEndian.Uint32(b[8:12]),
+			data: b[unix.SizeofNlMsghdr:msgLen],
+		})
+		aligned := (msgLen + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		if aligned > len(b) {
+			aligned = len(b)
+		}
+		b = b[aligned:]
+	}
+	return msgs, nil
+}
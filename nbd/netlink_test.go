@@ -0,0 +1,174 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// the expected bytes are little endian, as netlink uses the byte order of the host
+func skipBigEndian(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("expected bytes are little endian")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	skipBigEndian(t)
+	tests := []struct {
+		name  string
+		attrs attributes
+		want  []byte
+	}{
+		{"u32", attributes{}.u32(nbd_ATTR_INDEX, 3), []byte{8, 0, 1, 0, 3, 0, 0, 0}},
+		{"u64", attributes{}.u64(nbd_ATTR_SIZE_BYTES, 1<<20), []byte{12, 0, 2, 0, 0, 0, 0x10, 0, 0, 0, 0, 0}},
+		{"padded string", attributes{}.str(nbd_ATTR_BACKEND_IDENTIFIER, "ab"), []byte{7, 0, 10, 0, 'a', 'b', 0, 0}},
+		{"aligned string", attributes{}.str(nbd_ATTR_BACKEND_IDENTIFIER, "abc"), []byte{8, 0, 10, 0, 'a', 'b', 'c', 0}},
+		{"appended", attributes{}.u32(nbd_ATTR_INDEX, 1).u64(nbd_ATTR_TIMEOUT, 30), []byte{
+			8, 0, 1, 0, 1, 0, 0, 0,
+			12, 0, 4, 0, 30, 0, 0, 0, 0, 0, 0, 0,
+		}},
+		{"sockets", attributes{}.nested(nbd_ATTR_SOCKETS, socketItems([]uintptr{5, 6})), []byte{
+			28, 0, 7, 0x80,
+			12, 0, 1, 0x80, 8, 0, 1, 0, 5, 0, 0, 0,
+			12, 0, 1, 0x80, 8, 0, 1, 0, 6, 0, 0, 0,
+		}},
+		{"no sockets", attributes{}.nested(nbd_ATTR_SOCKETS, socketItems(nil)), []byte{4, 0, 7, 0x80}},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.attrs, test.want) {
+			t.Errorf("%s: got % x, expected % x", test.name, []byte(test.attrs), test.want)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	skipBigEndian(t)
+	tests := []struct {
+		name string
+		b    []byte
+		want []attribute
+	}{
+		{"empty", nil, []attribute{}},
+		{"u32", []byte{8, 0, 1, 0, 3, 0, 0, 0}, []attribute{{1, []byte{3, 0, 0, 0}}}},
+		{"padding skipped", []byte{7, 0, 10, 0, 'a', 'b', 0, 0, 5, 0, 2, 0, 1, 0, 0, 0}, []attribute{
+			{10, []byte{'a', 'b', 0}},
+			{2, []byte{1}},
+		}},
+		{"nested flag masked", []byte{12, 0, 7, 0x80, 8, 0, 1, 0, 5, 0, 0, 0}, []attribute{
+			{7, []byte{8, 0, 1, 0, 5, 0, 0, 0}},
+		}},
+		{"byte order flag masked", []byte{8, 0, 1, 0x40, 0, 0, 0, 1}, []attribute{{1, []byte{0, 0, 0, 1}}}},
+		{"no payload", []byte{4, 0, 9, 0}, []attribute{{9, []byte{}}}},
+		{"past the end", []byte{8, 0, 1, 0, 3, 0, 0, 0, 12, 0, 2, 0, 0, 0}, []attribute{{1, []byte{3, 0, 0, 0}}}},
+		{"shorter than a header", []byte{2, 0, 1, 0, 3, 0, 0, 0}, []attribute{}},
+		{"trailing bytes", []byte{8, 0, 1, 0, 3, 0, 0, 0, 1, 2}, []attribute{{1, []byte{3, 0, 0, 0}}}},
+	}
+	for _, test := range tests {
+		got := parseAttributes(test.b)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseMessages(t *testing.T) {
+	skipBigEndian(t)
+	tests := []struct {
+		name    string
+		b       []byte
+		want    []netlinkMessage
+		wantErr bool
+	}{
+		{"empty", nil, []netlinkMessage{}, false},
+		{"one", []byte{
+			20, 0, 0, 0, 0x1c, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0,
+			5, 1, 0, 0,
+		}, []netlinkMessage{{0x1c, 7, []byte{5, 1, 0, 0}}}, false},
+		{"padded", []byte{
+			17, 0, 0, 0, 0x1c, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0,
+			4, 0, 0, 0,
+			16, 0, 0, 0, 3, 0, 2, 0, 2, 0, 0, 0, 0, 0, 0, 0,
+		}, []netlinkMessage{{0x1c, 1, []byte{4}}, {3, 2, []byte{}}}, false},
+		{"unpadded last", []byte{17, 0, 0, 0, 0x1c, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 4}, []netlinkMessage{{0x1c, 1, []byte{4}}}, false},
+		{"shorter than a header", []byte{8, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil, true},
+		{"past the end", []byte{32, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseMessages(test.b)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLinkDead(t *testing.T) {
+	skipBigEndian(t)
+	index := func(i byte) []byte { return []byte{8, 0, 1, 0, i, 0, 0, 0} }
+	tests := []struct {
+		name          string
+		notifications []notification
+		want          bool
+	}{
+		{"none", nil, false},
+		{"this device", []notification{{uint8(nbd_NL_CMD_LINK_DEAD), index(2)}}, true},
+		{"other device", []notification{{uint8(nbd_NL_CMD_LINK_DEAD), index(1)}}, false},
+		{"other command", []notification{{uint8(nbd_NL_CMD_STATUS), index(2)}}, false},
+		{"later notification", []notification{
+			{uint8(nbd_NL_CMD_LINK_DEAD), index(1)},
+			{uint8(nbd_NL_CMD_LINK_DEAD), index(2)},
+		}, true},
+		{"truncated index", []notification{{uint8(nbd_NL_CMD_LINK_DEAD), []byte{6, 0, 1, 0, 2, 0, 0, 0}}}, false},
+	}
+	for _, test := range tests {
+		if got := linkDead(test.notifications, Device{Index: 2}); got != test.want {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want uint64
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{2 * time.Minute, 120},
+	}
+	for _, test := range tests {
+		if got := seconds(test.d); got != test.want {
+			t.Errorf("seconds(%v) = %d, expected %d", test.d, got, test.want)
+		}
+	}
+}
+
+func TestDeviceIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    int
+		wantErr bool
+	}{
+		{"", -1, false},
+		{"/dev/nbd0", 0, false},
+		{"/dev/nbd15", 15, false},
+		{"nbd3", 3, false},
+		{"/dev/sda", 0, true},
+		{"/dev/nbd", 0, true},
+		{"/dev/nbd-1", 0, true},
+	}
+	for _, test := range tests {
+		got, err := deviceIndex(test.name)
+		if (err != nil) != test.wantErr || (err == nil && got != test.want) {
+			t.Errorf("deviceIndex(%q) = %d, %v", test.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package nbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ClientOptions tune how the kernel serves a device, zero values keep the defaults
+type ClientOptions struct {
+	// Timeout of each request, the kernel fails requests, or treats the connection as dead
+	// when it can reconnect, after it
+	Timeout time.Duration
+	// BlockSize overrides the block size picked from the export, a power of two from 512
+	// up to the page size
+	BlockSize uint32
+	// DeadConnTimeout is how long requests stall while reconnecting, only over netlink
+	DeadConnTimeout time.Duration
+	// Connections is how many sockets the kernel spreads requests over when the export
+	// allows multiple connections, only over netlink, 0 is 1
+	Connections int
+	// DrainTimeout bounds writing back cached writes to the server before disconnecting
+	// on shutdown, 0 is 20s
+	DrainTimeout time.Duration
+	// Queue is applied through sysfs once the device is attached
+	Queue QueueOptions
+}
+
+// QueueOptions are the request queue settings in /sys/block/nbdX/queue
+type QueueOptions struct {
+	// MaxSectorsKB is the largest request the kernel sends, 0 or anything over the maximum
+	// block size of the export is that maximum
+	MaxSectorsKB uint32
+	ReadAheadKB  uint32
+	// Scheduler is the I/O scheduler like none or mq-deadline
+	Scheduler string
+}
+
+// defaultClientDrainTimeout matches the drain timeout of the server
+const defaultClientDrainTimeout = defaultDrainTimeout
+
+// Validate checks the options are ones the kernel takes
+func (o ClientOptions) Validate() error {
+	// the kernel takes block sizes up to the page size, which is more than 4096 on some arm64
+	if pageSize := uint32(os.Getpagesize()); o.BlockSize != 0 && (o.BlockSize < 512 || o.BlockSize > pageSize || o.BlockSize&(o.BlockSize-1) != 0) {
+		return fmt.Errorf("block size %d is not a power of two from 512 to the page size %d", o.BlockSize, pageSize)
+	}
+	if o.Connections < 0 {
+		return fmt.Errorf("%d connections is not a count of connections", o.Connections)
+	}
+	return nil
+}
+
+// deviceConfig applies the options to the config derived from the export
+func (o ClientOptions) deviceConfig(config DeviceConfig) DeviceConfig {
+	if o.Timeout != 0 {
+		config.Timeout = o.Timeout
+	}
+	if o.BlockSize != 0 {
+		config.BlockSize = o.BlockSize
+	}
+	if o.DeadConnTimeout != 0 {
+		config.DeadConnTimeout = o.DeadConnTimeout
+	}
+	return config
+}
+
+// limit keeps the largest request the kernel sends within the maximum block size of the
+// export, which the server refuses requests over
+func (q QueueOptions) limit(maximum uint32) QueueOptions {
+	// the kernel takes no less than a page
+	if kb := maximum / 1024; kb >= 4 && (q.MaxSectorsKB == 0 || q.MaxSectorsKB > kb) {
+		if q.MaxSectorsKB != 0 {
+			fmt.Printf("max sectors of %dKB is over what the export takes, using %dKB\n", q.MaxSectorsKB, kb)
+		}
+		q.MaxSectorsKB = kb
+	}
+	return q
+}
+
+// apply writes the settings to the queue of the device, a setting the kernel refuses
+// leaves the device usable so it is only logged
+func (q QueueOptions) apply(device Device) {
+	dir := filepath.Join(sysBlock, fmt.Sprintf("nbd%d", device.Index), "queue")
+	write := func(attr, value string) {
+		if err := os.WriteFile(filepath.Join(dir, attr), []byte(value), 0644); err != nil {
+			fmt.Printf("failed to set %s of %s to %s: %v\n", attr, device.Path(), value, err)
+		}
+	}
+	if q.MaxSectorsKB != 0 {
+		write("max_sectors_kb", strconv.FormatUint(uint64(q.MaxSectorsKB), 10))
+	}
+	if q.ReadAheadKB != 0 {
+		write("read_ahead_kb", strconv.FormatUint(uint64(q.ReadAheadKB), 10))
+	}
+	if q.Scheduler != "" {
+		write("scheduler", q.Scheduler)
+	}
+}
+
+// drain writes back the filesystems mounted from the device and what the page cache holds
+// for the device itself, and has the kernel send a flush, so nothing written is lost by
+// disconnecting, giving up after the drain timeout so an unreachable server does not hold
+// up the exit
+func (o ClientOptions) drain(device Device, f *os.File) {
+	timeout := o.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultClientDrainTimeout
+	}
+	synced := make(chan error, 1)
+	go func() {
+		// syncing the device does not write back the dirty pages of a filesystem on it,
+		// only mounts this process can see are found
+		mounts, err := device.mounts()
+		if err != nil {
+			fmt.Println("failed to find the mounts of", f.Name(), ":", err)
+		}
+		for _, mount := range mounts {
+			if err := syncfs(mount); err != nil {
+				fmt.Println("failed to write back", mount, "before disconnecting:", err)
+			}
+		}
+		synced <- f.Sync()
+	}()
+	select {
+	case err := <-synced:
+		if err != nil {
+			fmt.Println("failed to write back", f.Name(), "before disconnecting:", err)
+		}
+	case <-time.After(timeout):
+		fmt.Println("gave up writing back", f.Name(), "after", timeout)
+	}
+}
+
+// syncfs writes back the filesystem mounted at the path
+func syncfs(mount string) error {
+	fd, err := unix.Open(mount, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Syncfs(fd)
+}
+
+// mounts are where the device and its partitions are mounted in this mount namespace
+func (d Device) mounts() ([]string, error) {
+	dir := filepath.Join(sysBlock, fmt.Sprintf("nbd%d", d.Index))
+	partitions, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("nbd%dp*", d.Index)))
+	if err != nil {
+		return nil, err
+	}
+	devs := map[string]bool{}
+	for _, dir := range append([]string{dir}, partitions...) {
+		dev, err := readSysfs(dir, "dev")
+		if err != nil {
+			return nil, err
+		}
+		if dev != "" {
+			devs[dev] = true
+		}
+	}
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	return parseMountinfo(string(mountinfo), devs), nil
+}
+
+// mountinfoEscapes are how mountinfo escapes the whitespace and backslashes of paths
+var mountinfoEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// parseMountinfo finds the mount points of the devices, given as major:minor, in the
+// lines of /proc/self/mountinfo
+func parseMountinfo(mountinfo string, devs map[string]bool) []string {
+	mounts := []string{}
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !devs[fields[2]] {
+			continue
+		}
+		mounts = append(mounts, mountinfoEscapes.Replace(fields[4]))
+	}
+	return mounts
+}
@@ -0,0 +1,46 @@
+package nbd
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestClientOptionsValidate(t *testing.T) {
+	pageSize := uint32(os.Getpagesize())
+	tests := []struct {
+		opts    ClientOptions
+		wantErr bool
+	}{
+		{ClientOptions{}, false},
+		{ClientOptions{BlockSize: 512}, false},
+		{ClientOptions{BlockSize: 1024}, false},
+		{ClientOptions{BlockSize: 4096}, false},
+		{ClientOptions{BlockSize: 256}, true},
+		{ClientOptions{BlockSize: 1000}, true},
+		{ClientOptions{BlockSize: 3072}, true},
+		{ClientOptions{BlockSize: pageSize}, false},
+		{ClientOptions{BlockSize: 2 * pageSize}, true},
+		{ClientOptions{Connections: 4}, false},
+		{ClientOptions{Connections: -1}, true},
+	}
+	for _, test := range tests {
+		if err := test.opts.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%+v got %v", test.opts, err)
+		}
+	}
+}
+
+func TestParseMountinfo(t *testing.T) {
+	mountinfo := `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+36 22 43:0 / /mnt/data rw,noatime shared:20 - ext4 /dev/nbd0 rw
+37 22 43:1 / /mnt/with\040space rw shared:21 - xfs /dev/nbd0p1 rw
+38 22 43:32 / /mnt/other rw shared:22 - ext4 /dev/nbd1 rw
+39 36 43:0 /sub /var/lib/bind rw shared:20 - ext4 /dev/nbd0 rw
+`
+	got := parseMountinfo(mountinfo, map[string]bool{"43:0": true, "43:1": true})
+	want := []string{"/mnt/data", "/mnt/with space", "/var/lib/bind"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("mounts %q, expected %q", got, want)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/plockc/disk8s/nbd/internal/metrics"
 	"github.com/plockc/disk8s/nbd/internal/store"
 	"github.com/plockc/disk8s/nbd/replica"
 )
@@ -21,6 +22,7 @@ func main() {
 
 	ctx, cancel := context.WithCancel(killCtx)
 
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on /metrics at this address, e.g. :9090")
 	flag.Parse()
 
 	wg := sync.WaitGroup{}
@@ -41,6 +43,12 @@ func main() {
 		return "Data Disk", err
 	})
 
+	if *metricsAddr != "" {
+		routines = append(routines, func() (string, error) {
+			return "Metrics", metrics.Serve(ctx, *metricsAddr)
+		})
+	}
+
 	for _, r := range routines {
 		f := r // get copy off the heap as r changes and we're spawning usage of r
 		wg.Add(1)
@@ -68,7 +76,7 @@ func main() {
 }
 
 func handleSignal(ctx context.Context, cancel func()) {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	select {
 	case <-sigChan:
@@ -79,7 +87,7 @@ func handleSignal(ctx context.Context, cancel func()) {
 }
 
 func handleKill(ctx context.Context) {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Kill)
 	select {
 	case <-sigChan:
@@ -20,6 +20,61 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type StorageError_Kind int32
+
+const (
+	StorageError_IO           StorageError_Kind = 0
+	StorageError_OUT_OF_RANGE StorageError_Kind = 1
+	StorageError_NO_SPACE     StorageError_Kind = 2
+	StorageError_READ_ONLY    StorageError_Kind = 3
+	StorageError_TIMEOUT      StorageError_Kind = 4
+)
+
+// Enum value maps for StorageError_Kind.
+var (
+	StorageError_Kind_name = map[int32]string{
+		0: "IO",
+		1: "OUT_OF_RANGE",
+		2: "NO_SPACE",
+		3: "READ_ONLY",
+		4: "TIMEOUT",
+	}
+	StorageError_Kind_value = map[string]int32{
+		"IO":           0,
+		"OUT_OF_RANGE": 1,
+		"NO_SPACE":     2,
+		"READ_ONLY":    3,
+		"TIMEOUT":      4,
+	}
+)
+
+func (x StorageError_Kind) Enum() *StorageError_Kind {
+	p := new(StorageError_Kind)
+	*p = x
+	return p
+}
+
+func (x StorageError_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (StorageError_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_data_disk_proto_enumTypes[0].Descriptor()
+}
+
+func (StorageError_Kind) Type() protoreflect.EnumType {
+	return &file_data_disk_proto_enumTypes[0]
+}
+
+func (x StorageError_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use StorageError_Kind.Descriptor instead.
+func (StorageError_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{15, 0}
+}
+
 type ReadReq struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -82,6 +137,8 @@ type WriteReq struct {
 
 	Data   []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
 	Offset uint64 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	// fua (force unit access) asks for the write to be durable before responding
+	Fua bool `protobuf:"varint,3,opt,name=fua,proto3" json:"fua,omitempty"`
 }
 
 func (x *WriteReq) Reset() {
@@ -130,6 +187,13 @@ func (x *WriteReq) GetOffset() uint64 {
 	return 0
 }
 
+func (x *WriteReq) GetFua() bool {
+	if x != nil {
+		return x.Fua
+	}
+	return false
+}
+
 type WriteResp struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -300,6 +364,481 @@ func (x *SizeResp) GetSize() uint64 {
 	return 0
 }
 
+type FlushReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *FlushReq) Reset() {
+	*x = FlushReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FlushReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushReq) ProtoMessage() {}
+
+func (x *FlushReq) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushReq.ProtoReflect.Descriptor instead.
+func (*FlushReq) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{6}
+}
+
+type FlushResp struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *FlushResp) Reset() {
+	*x = FlushResp{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FlushResp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushResp) ProtoMessage() {}
+
+func (x *FlushResp) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushResp.ProtoReflect.Descriptor instead.
+func (*FlushResp) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{7}
+}
+
+type TrimReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Offset uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint64 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+}
+
+func (x *TrimReq) Reset() {
+	*x = TrimReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TrimReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TrimReq) ProtoMessage() {}
+
+func (x *TrimReq) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TrimReq.ProtoReflect.Descriptor instead.
+func (*TrimReq) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *TrimReq) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *TrimReq) GetLength() uint64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+type TrimResp struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *TrimResp) Reset() {
+	*x = TrimResp{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TrimResp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TrimResp) ProtoMessage() {}
+
+func (x *TrimResp) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TrimResp.ProtoReflect.Descriptor instead.
+func (*TrimResp) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{9}
+}
+
+type WriteZeroesReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Offset uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint64 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+	NoHole bool   `protobuf:"varint,3,opt,name=no_hole,json=noHole,proto3" json:"no_hole,omitempty"`
+}
+
+func (x *WriteZeroesReq) Reset() {
+	*x = WriteZeroesReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WriteZeroesReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteZeroesReq) ProtoMessage() {}
+
+func (x *WriteZeroesReq) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteZeroesReq.ProtoReflect.Descriptor instead.
+func (*WriteZeroesReq) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *WriteZeroesReq) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *WriteZeroesReq) GetLength() uint64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+func (x *WriteZeroesReq) GetNoHole() bool {
+	if x != nil {
+		return x.NoHole
+	}
+	return false
+}
+
+type WriteZeroesResp struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *WriteZeroesResp) Reset() {
+	*x = WriteZeroesResp{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WriteZeroesResp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteZeroesResp) ProtoMessage() {}
+
+func (x *WriteZeroesResp) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteZeroesResp.ProtoReflect.Descriptor instead.
+func (*WriteZeroesResp) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{11}
+}
+
+type ExtentsReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Offset uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint64 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+}
+
+func (x *ExtentsReq) Reset() {
+	*x = ExtentsReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ExtentsReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtentsReq) ProtoMessage() {}
+
+func (x *ExtentsReq) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtentsReq.ProtoReflect.Descriptor instead.
+func (*ExtentsReq) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ExtentsReq) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *ExtentsReq) GetLength() uint64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+type Extent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Length uint64 `protobuf:"varint,1,opt,name=length,proto3" json:"length,omitempty"`
+	Hole   bool   `protobuf:"varint,2,opt,name=hole,proto3" json:"hole,omitempty"`
+}
+
+func (x *Extent) Reset() {
+	*x = Extent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Extent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Extent) ProtoMessage() {}
+
+func (x *Extent) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Extent.ProtoReflect.Descriptor instead.
+func (*Extent) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *Extent) GetLength() uint64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+func (x *Extent) GetHole() bool {
+	if x != nil {
+		return x.Hole
+	}
+	return false
+}
+
+type ExtentsResp struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Extents []*Extent `protobuf:"bytes,1,rep,name=extents,proto3" json:"extents,omitempty"`
+}
+
+func (x *ExtentsResp) Reset() {
+	*x = ExtentsResp{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ExtentsResp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtentsResp) ProtoMessage() {}
+
+func (x *ExtentsResp) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtentsResp.ProtoReflect.Descriptor instead.
+func (*ExtentsResp) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *ExtentsResp) GetExtents() []*Extent {
+	if x != nil {
+		return x.Extents
+	}
+	return nil
+}
+
+// StorageError is attached to the status of a failed call with the kind of failure
+type StorageError struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Kind StorageError_Kind `protobuf:"varint,1,opt,name=kind,proto3,enum=replica.StorageError_Kind" json:"kind,omitempty"`
+}
+
+func (x *StorageError) Reset() {
+	*x = StorageError{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_data_disk_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StorageError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StorageError) ProtoMessage() {}
+
+func (x *StorageError) ProtoReflect() protoreflect.Message {
+	mi := &file_data_disk_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StorageError.ProtoReflect.Descriptor instead.
+func (*StorageError) Descriptor() ([]byte, []int) {
+	return file_data_disk_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *StorageError) GetKind() StorageError_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return StorageError_IO
+}
+
 var File_data_disk_proto protoreflect.FileDescriptor
 
 var file_data_disk_proto_rawDesc = []byte{
@@ -308,28 +847,76 @@ var file_data_disk_proto_rawDesc = []byte{
 	0x61, 0x64, 0x52, 0x65, 0x71, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20,
 	0x01, 0x28, 0x0d, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66,
 	0x73, 0x65, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65,
-	0x74, 0x22, 0x36, 0x0a, 0x08, 0x57, 0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x71, 0x12, 0x12, 0x0a,
+	0x74, 0x22, 0x48, 0x0a, 0x08, 0x57, 0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x71, 0x12, 0x12, 0x0a,
 	0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74,
 	0x61, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x04, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x22, 0x0b, 0x0a, 0x09, 0x57, 0x72, 0x69,
-	0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x1e, 0x0a, 0x08, 0x52, 0x65, 0x61, 0x64, 0x52, 0x65,
-	0x73, 0x70, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x09, 0x0a, 0x07, 0x53, 0x69, 0x7a, 0x65, 0x52, 0x65,
-	0x71, 0x22, 0x1e, 0x0a, 0x08, 0x53, 0x69, 0x7a, 0x65, 0x52, 0x65, 0x73, 0x70, 0x12, 0x12, 0x0a,
-	0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73, 0x69, 0x7a,
-	0x65, 0x32, 0x9a, 0x01, 0x0a, 0x08, 0x44, 0x61, 0x74, 0x61, 0x44, 0x69, 0x73, 0x6b, 0x12, 0x2d,
-	0x0a, 0x04, 0x52, 0x65, 0x61, 0x64, 0x12, 0x10, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61,
-	0x2e, 0x52, 0x65, 0x61, 0x64, 0x52, 0x65, 0x71, 0x1a, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69,
-	0x63, 0x61, 0x2e, 0x52, 0x65, 0x61, 0x64, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x30, 0x0a,
-	0x05, 0x57, 0x72, 0x69, 0x74, 0x65, 0x12, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61,
-	0x2e, 0x57, 0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x71, 0x1a, 0x12, 0x2e, 0x72, 0x65, 0x70, 0x6c,
-	0x69, 0x63, 0x61, 0x2e, 0x57, 0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12,
-	0x2d, 0x0a, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x10, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63,
-	0x61, 0x2e, 0x53, 0x69, 0x7a, 0x65, 0x52, 0x65, 0x71, 0x1a, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c,
-	0x69, 0x63, 0x61, 0x2e, 0x53, 0x69, 0x7a, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x42, 0x22,
-	0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x70, 0x6c, 0x6f,
-	0x63, 0x6b, 0x63, 0x2f, 0x6e, 0x64, 0x62, 0x2f, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2f,
-	0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x04, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x66, 0x75, 0x61,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x03, 0x66, 0x75, 0x61, 0x22, 0x0b, 0x0a, 0x09, 0x57,
+	0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x1e, 0x0a, 0x08, 0x52, 0x65, 0x61, 0x64,
+	0x52, 0x65, 0x73, 0x70, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x09, 0x0a, 0x07, 0x53, 0x69, 0x7a, 0x65,
+	0x52, 0x65, 0x71, 0x22, 0x1e, 0x0a, 0x08, 0x53, 0x69, 0x7a, 0x65, 0x52, 0x65, 0x73, 0x70, 0x12,
+	0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73,
+	0x69, 0x7a, 0x65, 0x22, 0x0a, 0x0a, 0x08, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x71, 0x22,
+	0x0b, 0x0a, 0x09, 0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x73, 0x70, 0x22, 0x39, 0x0a, 0x07,
+	0x54, 0x72, 0x69, 0x6d, 0x52, 0x65, 0x71, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65,
+	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12,
+	0x16, 0x0a, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x0a, 0x0a, 0x08, 0x54, 0x72, 0x69, 0x6d, 0x52,
+	0x65, 0x73, 0x70, 0x22, 0x59, 0x0a, 0x0e, 0x57, 0x72, 0x69, 0x74, 0x65, 0x5a, 0x65, 0x72, 0x6f,
+	0x65, 0x73, 0x52, 0x65, 0x71, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x16, 0x0a,
+	0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6c,
+	0x65, 0x6e, 0x67, 0x74, 0x68, 0x12, 0x17, 0x0a, 0x07, 0x6e, 0x6f, 0x5f, 0x68, 0x6f, 0x6c, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x6e, 0x6f, 0x48, 0x6f, 0x6c, 0x65, 0x22, 0x11,
+	0x0a, 0x0f, 0x57, 0x72, 0x69, 0x74, 0x65, 0x5a, 0x65, 0x72, 0x6f, 0x65, 0x73, 0x52, 0x65, 0x73,
+	0x70, 0x22, 0x3c, 0x0a, 0x0a, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x12,
+	0x16, 0x0a, 0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x06, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74,
+	0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22,
+	0x34, 0x0a, 0x06, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x65, 0x6e,
+	0x67, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x6c, 0x65, 0x6e, 0x67, 0x74,
+	0x68, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x6f, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x04, 0x68, 0x6f, 0x6c, 0x65, 0x22, 0x38, 0x0a, 0x0b, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73,
+	0x52, 0x65, 0x73, 0x70, 0x12, 0x29, 0x0a, 0x07, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x18,
+	0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e,
+	0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x52, 0x07, 0x65, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x22,
+	0x8a, 0x01, 0x0a, 0x0c, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x45, 0x72, 0x72, 0x6f, 0x72,
+	0x12, 0x2e, 0x0a, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1a,
+	0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65,
+	0x45, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x4b, 0x69, 0x6e, 0x64, 0x52, 0x04, 0x6b, 0x69, 0x6e, 0x64,
+	0x22, 0x4a, 0x0a, 0x04, 0x4b, 0x69, 0x6e, 0x64, 0x12, 0x06, 0x0a, 0x02, 0x49, 0x4f, 0x10, 0x00,
+	0x12, 0x10, 0x0a, 0x0c, 0x4f, 0x55, 0x54, 0x5f, 0x4f, 0x46, 0x5f, 0x52, 0x41, 0x4e, 0x47, 0x45,
+	0x10, 0x01, 0x12, 0x0c, 0x0a, 0x08, 0x4e, 0x4f, 0x5f, 0x53, 0x50, 0x41, 0x43, 0x45, 0x10, 0x02,
+	0x12, 0x0d, 0x0a, 0x09, 0x52, 0x45, 0x41, 0x44, 0x5f, 0x4f, 0x4e, 0x4c, 0x59, 0x10, 0x03, 0x12,
+	0x0b, 0x0a, 0x07, 0x54, 0x49, 0x4d, 0x45, 0x4f, 0x55, 0x54, 0x10, 0x04, 0x32, 0xf7, 0x02, 0x0a,
+	0x08, 0x44, 0x61, 0x74, 0x61, 0x44, 0x69, 0x73, 0x6b, 0x12, 0x2d, 0x0a, 0x04, 0x52, 0x65, 0x61,
+	0x64, 0x12, 0x10, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x52, 0x65, 0x61, 0x64,
+	0x52, 0x65, 0x71, 0x1a, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x52, 0x65,
+	0x61, 0x64, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x30, 0x0a, 0x05, 0x57, 0x72, 0x69, 0x74,
+	0x65, 0x12, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x57, 0x72, 0x69, 0x74,
+	0x65, 0x52, 0x65, 0x71, 0x1a, 0x12, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x57,
+	0x72, 0x69, 0x74, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x2d, 0x0a, 0x04, 0x53, 0x69,
+	0x7a, 0x65, 0x12, 0x10, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x53, 0x69, 0x7a,
+	0x65, 0x52, 0x65, 0x71, 0x1a, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x53,
+	0x69, 0x7a, 0x65, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x30, 0x0a, 0x05, 0x46, 0x6c, 0x75,
+	0x73, 0x68, 0x12, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x46, 0x6c, 0x75,
+	0x73, 0x68, 0x52, 0x65, 0x71, 0x1a, 0x12, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e,
+	0x46, 0x6c, 0x75, 0x73, 0x68, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x2d, 0x0a, 0x04, 0x54,
+	0x72, 0x69, 0x6d, 0x12, 0x10, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x54, 0x72,
+	0x69, 0x6d, 0x52, 0x65, 0x71, 0x1a, 0x11, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e,
+	0x54, 0x72, 0x69, 0x6d, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x42, 0x0a, 0x0b, 0x57, 0x72,
+	0x69, 0x74, 0x65, 0x5a, 0x65, 0x72, 0x6f, 0x65, 0x73, 0x12, 0x17, 0x2e, 0x72, 0x65, 0x70, 0x6c,
+	0x69, 0x63, 0x61, 0x2e, 0x57, 0x72, 0x69, 0x74, 0x65, 0x5a, 0x65, 0x72, 0x6f, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x1a, 0x18, 0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x57, 0x72, 0x69,
+	0x74, 0x65, 0x5a, 0x65, 0x72, 0x6f, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x12, 0x36,
+	0x0a, 0x07, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x13, 0x2e, 0x72, 0x65, 0x70, 0x6c,
+	0x69, 0x63, 0x61, 0x2e, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x1a, 0x14,
+	0x2e, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2e, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x74, 0x73,
+	0x52, 0x65, 0x73, 0x70, 0x22, 0x00, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x70, 0x6c, 0x6f, 0x63, 0x6b, 0x63, 0x2f, 0x6e, 0x64, 0x62, 0x2f,
+	0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x33,
 }
 
 var (
@@ -344,27 +931,49 @@ func file_data_disk_proto_rawDescGZIP() []byte {
 	return file_data_disk_proto_rawDescData
 }
 
-var file_data_disk_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_data_disk_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_data_disk_proto_msgTypes = make([]protoimpl.MessageInfo, 16)
 var file_data_disk_proto_goTypes = []interface{}{
-	(*ReadReq)(nil),   // 0: replica.ReadReq
-	(*WriteReq)(nil),  // 1: replica.WriteReq
-	(*WriteResp)(nil), // 2: replica.WriteResp
-	(*ReadResp)(nil),  // 3: replica.ReadResp
-	(*SizeReq)(nil),   // 4: replica.SizeReq
-	(*SizeResp)(nil),  // 5: replica.SizeResp
+	(StorageError_Kind)(0),  // 0: replica.StorageError.Kind
+	(*ReadReq)(nil),         // 1: replica.ReadReq
+	(*WriteReq)(nil),        // 2: replica.WriteReq
+	(*WriteResp)(nil),       // 3: replica.WriteResp
+	(*ReadResp)(nil),        // 4: replica.ReadResp
+	(*SizeReq)(nil),         // 5: replica.SizeReq
+	(*SizeResp)(nil),        // 6: replica.SizeResp
+	(*FlushReq)(nil),        // 7: replica.FlushReq
+	(*FlushResp)(nil),       // 8: replica.FlushResp
+	(*TrimReq)(nil),         // 9: replica.TrimReq
+	(*TrimResp)(nil),        // 10: replica.TrimResp
+	(*WriteZeroesReq)(nil),  // 11: replica.WriteZeroesReq
+	(*WriteZeroesResp)(nil), // 12: replica.WriteZeroesResp
+	(*ExtentsReq)(nil),      // 13: replica.ExtentsReq
+	(*Extent)(nil),          // 14: replica.Extent
+	(*ExtentsResp)(nil),     // 15: replica.ExtentsResp
+	(*StorageError)(nil),    // 16: replica.StorageError
 }
 var file_data_disk_proto_depIdxs = []int32{
-	0, // 0: replica.DataDisk.Read:input_type -> replica.ReadReq
-	1, // 1: replica.DataDisk.Write:input_type -> replica.WriteReq
-	4, // 2: replica.DataDisk.Size:input_type -> replica.SizeReq
-	3, // 3: replica.DataDisk.Read:output_type -> replica.ReadResp
-	2, // 4: replica.DataDisk.Write:output_type -> replica.WriteResp
-	5, // 5: replica.DataDisk.Size:output_type -> replica.SizeResp
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	14, // 0: replica.ExtentsResp.extents:type_name -> replica.Extent
+	0,  // 1: replica.StorageError.kind:type_name -> replica.StorageError.Kind
+	1,  // 2: replica.DataDisk.Read:input_type -> replica.ReadReq
+	2,  // 3: replica.DataDisk.Write:input_type -> replica.WriteReq
+	5,  // 4: replica.DataDisk.Size:input_type -> replica.SizeReq
+	7,  // 5: replica.DataDisk.Flush:input_type -> replica.FlushReq
+	9,  // 6: replica.DataDisk.Trim:input_type -> replica.TrimReq
+	11, // 7: replica.DataDisk.WriteZeroes:input_type -> replica.WriteZeroesReq
+	13, // 8: replica.DataDisk.Extents:input_type -> replica.ExtentsReq
+	4,  // 9: replica.DataDisk.Read:output_type -> replica.ReadResp
+	3,  // 10: replica.DataDisk.Write:output_type -> replica.WriteResp
+	6,  // 11: replica.DataDisk.Size:output_type -> replica.SizeResp
+	8,  // 12: replica.DataDisk.Flush:output_type -> replica.FlushResp
+	10, // 13: replica.DataDisk.Trim:output_type -> replica.TrimResp
+	12, // 14: replica.DataDisk.WriteZeroes:output_type -> replica.WriteZeroesResp
+	15, // 15: replica.DataDisk.Extents:output_type -> replica.ExtentsResp
+	9,  // [9:16] is the sub-list for method output_type
+	2,  // [2:9] is the sub-list for method input_type
+	2,  // [2:2] is the sub-list for extension type_name
+	2,  // [2:2] is the sub-list for extension extendee
+	0,  // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_data_disk_proto_init() }
@@ -445,19 +1054,140 @@ func file_data_disk_proto_init() {
 				return nil
 			}
 		}
+		file_data_disk_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FlushReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FlushResp); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TrimReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TrimResp); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WriteZeroesReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WriteZeroesResp); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ExtentsReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Extent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ExtentsResp); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_data_disk_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StorageError); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_data_disk_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   6,
+			NumEnums:      1,
+			NumMessages:   16,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_data_disk_proto_goTypes,
 		DependencyIndexes: file_data_disk_proto_depIdxs,
+		EnumInfos:         file_data_disk_proto_enumTypes,
 		MessageInfos:      file_data_disk_proto_msgTypes,
 	}.Build()
 	File_data_disk_proto = out.File
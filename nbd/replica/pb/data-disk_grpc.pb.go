@@ -25,6 +25,10 @@ type DataDiskClient interface {
 	Read(ctx context.Context, in *ReadReq, opts ...grpc.CallOption) (*ReadResp, error)
 	Write(ctx context.Context, in *WriteReq, opts ...grpc.CallOption) (*WriteResp, error)
 	Size(ctx context.Context, in *SizeReq, opts ...grpc.CallOption) (*SizeResp, error)
+	Flush(ctx context.Context, in *FlushReq, opts ...grpc.CallOption) (*FlushResp, error)
+	Trim(ctx context.Context, in *TrimReq, opts ...grpc.CallOption) (*TrimResp, error)
+	WriteZeroes(ctx context.Context, in *WriteZeroesReq, opts ...grpc.CallOption) (*WriteZeroesResp, error)
+	Extents(ctx context.Context, in *ExtentsReq, opts ...grpc.CallOption) (*ExtentsResp, error)
 }
 
 type dataDiskClient struct {
@@ -62,6 +66,42 @@ func (c *dataDiskClient) Size(ctx context.Context, in *SizeReq, opts ...grpc.Cal
 	return out, nil
 }
 
+func (c *dataDiskClient) Flush(ctx context.Context, in *FlushReq, opts ...grpc.CallOption) (*FlushResp, error) {
+	out := new(FlushResp)
+	err := c.cc.Invoke(ctx, "/replica.DataDisk/Flush", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataDiskClient) Trim(ctx context.Context, in *TrimReq, opts ...grpc.CallOption) (*TrimResp, error) {
+	out := new(TrimResp)
+	err := c.cc.Invoke(ctx, "/replica.DataDisk/Trim", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataDiskClient) WriteZeroes(ctx context.Context, in *WriteZeroesReq, opts ...grpc.CallOption) (*WriteZeroesResp, error) {
+	out := new(WriteZeroesResp)
+	err := c.cc.Invoke(ctx, "/replica.DataDisk/WriteZeroes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataDiskClient) Extents(ctx context.Context, in *ExtentsReq, opts ...grpc.CallOption) (*ExtentsResp, error) {
+	out := new(ExtentsResp)
+	err := c.cc.Invoke(ctx, "/replica.DataDisk/Extents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DataDiskServer is the server API for DataDisk service.
 // All implementations must embed UnimplementedDataDiskServer
 // for forward compatibility
@@ -69,6 +109,10 @@ type DataDiskServer interface {
 	Read(context.Context, *ReadReq) (*ReadResp, error)
 	Write(context.Context, *WriteReq) (*WriteResp, error)
 	Size(context.Context, *SizeReq) (*SizeResp, error)
+	Flush(context.Context, *FlushReq) (*FlushResp, error)
+	Trim(context.Context, *TrimReq) (*TrimResp, error)
+	WriteZeroes(context.Context, *WriteZeroesReq) (*WriteZeroesResp, error)
+	Extents(context.Context, *ExtentsReq) (*ExtentsResp, error)
 	mustEmbedUnimplementedDataDiskServer()
 }
 
@@ -85,6 +129,18 @@ func (UnimplementedDataDiskServer) Write(context.Context, *WriteReq) (*WriteResp
 func (UnimplementedDataDiskServer) Size(context.Context, *SizeReq) (*SizeResp, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Size not implemented")
 }
+func (UnimplementedDataDiskServer) Flush(context.Context, *FlushReq) (*FlushResp, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Flush not implemented")
+}
+func (UnimplementedDataDiskServer) Trim(context.Context, *TrimReq) (*TrimResp, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Trim not implemented")
+}
+func (UnimplementedDataDiskServer) WriteZeroes(context.Context, *WriteZeroesReq) (*WriteZeroesResp, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WriteZeroes not implemented")
+}
+func (UnimplementedDataDiskServer) Extents(context.Context, *ExtentsReq) (*ExtentsResp, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Extents not implemented")
+}
 func (UnimplementedDataDiskServer) mustEmbedUnimplementedDataDiskServer() {}
 
 // UnsafeDataDiskServer may be embedded to opt out of forward compatibility for this service.
@@ -152,6 +208,78 @@ func _DataDisk_Size_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _DataDisk_Flush_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlushReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataDiskServer).Flush(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/replica.DataDisk/Flush",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataDiskServer).Flush(ctx, req.(*FlushReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataDisk_Trim_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TrimReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataDiskServer).Trim(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/replica.DataDisk/Trim",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataDiskServer).Trim(ctx, req.(*TrimReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataDisk_WriteZeroes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WriteZeroesReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataDiskServer).WriteZeroes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/replica.DataDisk/WriteZeroes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataDiskServer).WriteZeroes(ctx, req.(*WriteZeroesReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataDisk_Extents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExtentsReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataDiskServer).Extents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/replica.DataDisk/Extents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataDiskServer).Extents(ctx, req.(*ExtentsReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // DataDisk_ServiceDesc is the grpc.ServiceDesc for DataDisk service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -171,6 +299,22 @@ var DataDisk_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Size",
 			Handler:    _DataDisk_Size_Handler,
 		},
+		{
+			MethodName: "Flush",
+			Handler:    _DataDisk_Flush_Handler,
+		},
+		{
+			MethodName: "Trim",
+			Handler:    _DataDisk_Trim_Handler,
+		},
+		{
+			MethodName: "WriteZeroes",
+			Handler:    _DataDisk_WriteZeroes_Handler,
+		},
+		{
+			MethodName: "Extents",
+			Handler:    _DataDisk_Extents_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "data-disk.proto",
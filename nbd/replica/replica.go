@@ -6,11 +6,10 @@ import (
 	"log"
 	"net"
 
+	"github.com/plockc/disk8s/nbd/internal/metrics"
 	"github.com/plockc/disk8s/nbd/internal/store"
 	"github.com/plockc/disk8s/nbd/replica/pb"
 	grpc "google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	status "google.golang.org/grpc/status"
 )
 
 type dataDiskServer struct {
@@ -33,7 +32,7 @@ func (s dataDiskServer) Read(ctx context.Context, req *pb.ReadReq) (*pb.ReadResp
 	buff := make([]byte, req.Size)
 	err := s.Storage.ReadAt(ctx, buff, uint64(req.Offset))
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, store.StatusError(err)
 	}
 	return &pb.ReadResp{
 		Data: buff,
@@ -41,19 +40,57 @@ func (s dataDiskServer) Read(ctx context.Context, req *pb.ReadReq) (*pb.ReadResp
 }
 
 func (s dataDiskServer) Write(ctx context.Context, req *pb.WriteReq) (*pb.WriteResp, error) {
-	log.Printf("GRPC RESPOND WRITE at:%d, %d bytes\n", req.Offset, len(req.Data))
-	err := s.Storage.WriteAt(ctx, req.Data, uint64(req.Offset))
+	log.Printf("GRPC RESPOND WRITE at:%d, %d bytes, fua: %v\n", req.Offset, len(req.Data), req.Fua)
+	// with fua the write is durable before the response is sent
+	err := s.Storage.WriteAt(ctx, req.Data, uint64(req.Offset), req.Fua)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, store.StatusError(err)
 	}
 	return &pb.WriteResp{}, nil
 }
 
+func (s dataDiskServer) Trim(ctx context.Context, req *pb.TrimReq) (*pb.TrimResp, error) {
+	log.Printf("GRPC RESPOND TRIM at:%d, %d bytes\n", req.Offset, req.Length)
+	if err := s.Storage.Trim(ctx, req.Offset, req.Length); err != nil {
+		return nil, store.StatusError(err)
+	}
+	return &pb.TrimResp{}, nil
+}
+
+func (s dataDiskServer) WriteZeroes(ctx context.Context, req *pb.WriteZeroesReq) (*pb.WriteZeroesResp, error) {
+	log.Printf("GRPC RESPOND WRITE ZEROES at:%d, %d bytes\n", req.Offset, req.Length)
+	if err := s.Storage.WriteZeroes(ctx, req.Offset, req.Length, req.NoHole); err != nil {
+		return nil, store.StatusError(err)
+	}
+	return &pb.WriteZeroesResp{}, nil
+}
+
+func (s dataDiskServer) Extents(ctx context.Context, req *pb.ExtentsReq) (*pb.ExtentsResp, error) {
+	log.Printf("GRPC RESPOND EXTENTS at:%d, %d bytes\n", req.Offset, req.Length)
+	extents, err := s.Storage.Extents(ctx, req.Offset, req.Length)
+	if err != nil {
+		return nil, store.StatusError(err)
+	}
+	resp := &pb.ExtentsResp{Extents: make([]*pb.Extent, len(extents))}
+	for i, e := range extents {
+		resp.Extents[i] = &pb.Extent{Length: e.Length, Hole: e.Hole}
+	}
+	return resp, nil
+}
+
+func (s dataDiskServer) Flush(ctx context.Context, req *pb.FlushReq) (*pb.FlushResp, error) {
+	log.Println("GRPC RESPOND FLUSH")
+	if err := s.Storage.Flush(ctx); err != nil {
+		return nil, store.StatusError(err)
+	}
+	return &pb.FlushResp{}, nil
+}
+
 func (s dataDiskServer) Size(ctx context.Context, req *pb.SizeReq) (*pb.SizeResp, error) {
 	log.Printf("GRPC RESPOND SIZE")
 	size, err := s.Storage.Size(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, store.StatusError(err)
 	}
 	return &pb.SizeResp{Size: size}, nil
 }
@@ -63,7 +100,7 @@ func (s *dataDiskServer) HandleRequests(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on port 10808: %w", err)
 	}
-	srvr := grpc.NewServer()
+	srvr := grpc.NewServer(grpc.UnaryInterceptor(metrics.UnaryServerInterceptor))
 	pb.RegisterDataDiskServer(srvr, s)
 	// if parent context stops we can gracefully stop the server
 	ctx, cancel := context.WithCancel(ctx)
@@ -1,7 +1,11 @@
 package nbd
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
 )
 
 const (
@@ -21,3 +25,149 @@ func newReply(handle uint64) *reply {
 func (r *reply) err(err uint32) {
 	binary.BigEndian.PutUint32((*r)[4:8], err)
 }
+
+// error values sent in replies, these are the linux errno values the protocol uses
+// regardless of the platform of the server
+const (
+	nbd_EPERM     uint32 = 1
+	nbd_EIO       uint32 = 5
+	nbd_EINVAL    uint32 = 22
+	nbd_ENOSPC    uint32 = 28
+	nbd_ESHUTDOWN uint32 = 108
+	nbd_ETIMEDOUT uint32 = 110
+)
+
+// errno picks the error to send to the client for a storage error
+func errno(err error) uint32 {
+	switch {
+	case errors.Is(err, store.ErrOutOfRange):
+		return nbd_EINVAL
+	case errors.Is(err, store.ErrNoSpace):
+		return nbd_ENOSPC
+	case errors.Is(err, store.ErrReadOnly):
+		return nbd_EPERM
+	case errors.Is(err, store.ErrTimeout):
+		return nbd_ETIMEDOUT
+	case errors.Is(err, context.Canceled):
+		// the server is going away, the client can retry elsewhere
+		return nbd_ESHUTDOWN
+	}
+	// any other failure of the storage is an i/o error to the client
+	return nbd_EIO
+}
+
+// structured replies, negotiated with nbd_OPT_STRUCTURED_REPLY, send a reply as one or
+// more chunks, the last chunk is flagged as done
+const (
+	nbd_STRUCTURED_REPLY_MAGIC = 0x668e33ef
+	// every reply is a chunk with a 64 bit length once extended headers are negotiated
+	nbd_EXTENDED_REPLY_MAGIC = 0x6e8a278c
+
+	nbd_REPLY_FLAG_DONE uint16 = 1 << 0
+
+	// holeBlockSize is the granularity reads are checked for holes
+	holeBlockSize = 4096
+	// maxDataChunk splits large reads into several data chunks
+	maxDataChunk = 256 * 1024
+)
+
+type chunkType uint16
+
+const (
+	nbd_REPLY_TYPE_NONE         chunkType = 0
+	nbd_REPLY_TYPE_OFFSET_DATA  chunkType = 1
+	nbd_REPLY_TYPE_OFFSET_HOLE  chunkType = 2
+	nbd_REPLY_TYPE_BLOCK_STATUS chunkType = 5
+	// nbd_REPLY_TYPE_BLOCK_STATUS_EXT replaces nbd_REPLY_TYPE_BLOCK_STATUS with extended headers
+	nbd_REPLY_TYPE_BLOCK_STATUS_EXT chunkType = 6
+	nbd_REPLY_TYPE_ERROR            chunkType = 1<<15 + 1
+)
+
+// chunkHeader is followed by length bytes of payload specific to the chunk type, the
+// header is in the extended format if it was negotiated
+func (ss *serviceSocket) chunkHeader(req request, flags uint16, typ chunkType, length uint64) []byte {
+	if ss.extendedHeaders {
+		h := make([]byte, 32)
+		binary.BigEndian.PutUint32(h[0:4], nbd_EXTENDED_REPLY_MAGIC)
+		binary.BigEndian.PutUint16(h[4:6], flags)
+		binary.BigEndian.PutUint16(h[6:8], uint16(typ))
+		binary.BigEndian.PutUint64(h[8:16], req.handle())
+		binary.BigEndian.PutUint64(h[16:24], req.offset())
+		binary.BigEndian.PutUint64(h[24:32], length)
+		return h
+	}
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint32(h[0:4], nbd_STRUCTURED_REPLY_MAGIC)
+	binary.BigEndian.PutUint16(h[4:6], flags)
+	binary.BigEndian.PutUint16(h[6:8], uint16(typ))
+	binary.BigEndian.PutUint64(h[8:16], req.handle())
+	binary.BigEndian.PutUint32(h[16:20], uint32(length))
+	return h
+}
+
+// errorChunk ends a structured reply with an error and a message for humans
+func (ss *serviceSocket) errorChunk(req request, err uint32, message string) []byte {
+	if len(message) > 4096 {
+		message = message[:4096]
+	}
+	c := ss.chunkHeader(req, nbd_REPLY_FLAG_DONE, nbd_REPLY_TYPE_ERROR, uint64(6+len(message)))
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint32(payload[0:4], err)
+	binary.BigEndian.PutUint16(payload[4:6], uint16(len(message)))
+	return append(append(c, payload...), message...)
+}
+
+// readChunks replies to a read, zeroed blocks are sent as holes without any data and
+// the rest is split into data chunks
+func (ss *serviceSocket) readChunks(req request, data []byte) response {
+	if len(data) == 0 {
+		return response{ss.chunkHeader(req, nbd_REPLY_FLAG_DONE, nbd_REPLY_TYPE_NONE, 0)}
+	}
+	offset := req.offset()
+	var resp response
+	var lastHeader []byte
+	for start := 0; start < len(data); {
+		hole := isZero(data[start:nextBlock(offset, start, len(data))])
+		end := start
+		for end < len(data) {
+			blockEnd := nextBlock(offset, end, len(data))
+			if isZero(data[end:blockEnd]) != hole || (!hole && blockEnd-start > maxDataChunk && end > start) {
+				break
+			}
+			end = blockEnd
+		}
+		chunkOffset := make([]byte, 8)
+		binary.BigEndian.PutUint64(chunkOffset, offset+uint64(start))
+		if hole {
+			lastHeader = ss.chunkHeader(req, 0, nbd_REPLY_TYPE_OFFSET_HOLE, 12)
+			holeSize := make([]byte, 4)
+			binary.BigEndian.PutUint32(holeSize, uint32(end-start))
+			resp = append(resp, lastHeader, chunkOffset, holeSize)
+		} else {
+			lastHeader = ss.chunkHeader(req, 0, nbd_REPLY_TYPE_OFFSET_DATA, uint64(8+end-start))
+			resp = append(resp, lastHeader, chunkOffset, data[start:end])
+		}
+		start = end
+	}
+	binary.BigEndian.PutUint16(lastHeader[4:6], nbd_REPLY_FLAG_DONE)
+	return resp
+}
+
+// nextBlock finds where the hole block containing data[i] ends, blocks are aligned
+// to the device rather than to the read
+func nextBlock(offset uint64, i, length int) int {
+	end := i + holeBlockSize - int((offset+uint64(i))%holeBlockSize)
+	if end > length {
+		return length
+	}
+	return end
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+func TestErrno(t *testing.T) {
+	tests := []struct {
+		err  error
+		want uint32
+	}{
+		{store.ErrOutOfRange, nbd_EINVAL},
+		{store.ErrNoSpace, nbd_ENOSPC},
+		{store.ErrReadOnly, nbd_EPERM},
+		{store.ErrTimeout, nbd_ETIMEDOUT},
+		{store.ErrIO, nbd_EIO},
+		{context.Canceled, nbd_ESHUTDOWN},
+		{fmt.Errorf("%w: replica went away", store.ErrTimeout), nbd_ETIMEDOUT},
+		{fmt.Errorf("%w: disk full", store.ErrNoSpace), nbd_ENOSPC},
+		{errors.New("unclassified"), nbd_EIO},
+	}
+	for _, test := range tests {
+		if got := errno(test.err); got != test.want {
+			t.Errorf("errno(%v) = %d, expected %d", test.err, got, test.want)
+		}
+	}
+}
+
+// decodeChunks describes each chunk of a structured reply to a read, checking that only the
+// last chunk is flagged as done
+func decodeChunks(t *testing.T, resp response) []string {
+	t.Helper()
+	var chunks []string
+	for i := 0; i < len(resp); i += 3 {
+		header := resp[i]
+		if done := binary.BigEndian.Uint16(header[4:6]) == nbd_REPLY_FLAG_DONE; done != (i+3 >= len(resp)) {
+			t.Fatalf("chunk %d has done %v with %d chunks", i/3, done, len(resp)/3)
+		}
+		switch chunkType(binary.BigEndian.Uint16(header[6:8])) {
+		case nbd_REPLY_TYPE_NONE:
+			chunks = append(chunks, "none")
+		case nbd_REPLY_TYPE_OFFSET_DATA:
+			if int(binary.BigEndian.Uint32(header[16:20])) != 8+len(resp[i+2]) {
+				t.Fatalf("data chunk %d length does not match its payload", i/3)
+			}
+			chunks = append(chunks, fmt.Sprintf("data %d+%d", binary.BigEndian.Uint64(resp[i+1]), len(resp[i+2])))
+		case nbd_REPLY_TYPE_OFFSET_HOLE:
+			chunks = append(chunks, fmt.Sprintf("hole %d+%d", binary.BigEndian.Uint64(resp[i+1]), binary.BigEndian.Uint32(resp[i+2])))
+		default:
+			t.Fatalf("unexpected chunk type %d", binary.BigEndian.Uint16(header[6:8]))
+		}
+	}
+	return chunks
+}
+
+// blocks is a read of length bytes at offset where the device blocks numbered in used hold data
+func blocks(offset uint64, length int, used ...uint64) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		for _, block := range used {
+			if (offset+uint64(i))/holeBlockSize == block {
+				data[i] = 1
+			}
+		}
+	}
+	return data
+}
+
+func TestReadChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset uint64
+		data   []byte
+		want   []string
+	}{
+		{"empty", 0, nil, []string{"none"}},
+		{"all data", 0, blocks(0, 8192, 0, 1), []string{"data 0+8192"}},
+		{"all hole", 4096, blocks(4096, 8192), []string{"hole 4096+8192"}},
+		{"hole in the middle", 0, blocks(0, 3*4096, 0, 2), []string{"data 0+4096", "hole 4096+4096", "data 8192+4096"}},
+		{"unaligned data edges", 100, blocks(100, 3*4096, 0, 3), []string{"data 100+3996", "hole 4096+8192", "data 12288+100"}},
+		{"unaligned hole edges", 100, blocks(100, 3*4096, 1), []string{"hole 100+3996", "data 4096+4096", "hole 8192+4196"}},
+		{"within one block", 5000, blocks(5000, 100, 1), []string{"data 5000+100"}},
+		{"large data is split", 0, bytes.Repeat([]byte{1}, 600*1024), []string{"data 0+262144", "data 262144+262144", "data 524288+90112"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := request(clientRequest(nbd_CMD_READ, 0, 7, test.offset, uint32(len(test.data))))
+			resp := (&serviceSocket{structuredReplies: true}).readChunks(req, test.data)
+			if got := decodeChunks(t, resp); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("chunks %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,11 @@ import "encoding/binary"
 
 const (
 	nbd_REQUEST_MAGIC = 0x25609513
+	// requests have a 64 bit length once nbd_OPT_EXTENDED_HEADERS is negotiated
+	nbd_EXTENDED_REQUEST_MAGIC = 0x21e41c71
+
+	requestSize         = 28
+	extendedRequestSize = 32
 )
 
 type command uint32
@@ -14,16 +19,58 @@ const (
 	nbd_CMD_DISC  command = 2
 	nbd_CMD_FLUSH command = 3
 	nbd_CMD_TRIM  command = 4
+
+	nbd_CMD_WRITE_ZEROES command = 6
+	nbd_CMD_BLOCK_STATUS command = 7
 )
 
+// commandFlags modify how the server carries out a command
+type commandFlags uint16
+
+const (
+	nbd_CMD_FLAG_FUA     commandFlags = 1 << 0
+	nbd_CMD_FLAG_NO_HOLE commandFlags = 1 << 1
+	nbd_CMD_FLAG_REQ_ONE commandFlags = 1 << 3
+)
+
+// maxPayload bounds the data of a read or write, so a client cannot make the server
+// allocate without limit
+const maxPayload = 32 * 1024 * 1024
+
+// validFlags are the flags each command accepts on top of nbd_CMD_FLAG_FUA, commands
+// missing from here are unknown to the server
+var validFlags = map[command]commandFlags{
+	nbd_CMD_READ:         0,
+	nbd_CMD_WRITE:        0,
+	nbd_CMD_DISC:         0,
+	nbd_CMD_FLUSH:        0,
+	nbd_CMD_TRIM:         0,
+	nbd_CMD_WRITE_ZEROES: nbd_CMD_FLAG_NO_HOLE,
+	nbd_CMD_BLOCK_STATUS: nbd_CMD_FLAG_REQ_ONE,
+}
+
+// commandFlag is the transmission flag that has to be advertised before a client
+// may send the command
+var commandFlag = map[command]uint16{
+	nbd_CMD_FLUSH:        nbd_FLAG_SEND_FLUSH,
+	nbd_CMD_TRIM:         nbd_FLAG_SEND_TRIM,
+	nbd_CMD_WRITE_ZEROES: nbd_FLAG_SEND_WRITE_ZEROES,
+}
+
+// request is a compact or extended request header, told apart by its size
 type request []byte
 
 func (r request) magic() uint32 {
 	return binary.BigEndian.Uint32(r[0:4])
 }
 
+// flags are the upper 16 bits of the command type field
+func (r request) flags() commandFlags {
+	return commandFlags(binary.BigEndian.Uint16(r[4:6]))
+}
+
 func (r request) command() command {
-	return command(binary.BigEndian.Uint32(r[4:8]))
+	return command(binary.BigEndian.Uint16(r[6:8]))
 }
 func (r request) handle() uint64 {
 	return binary.BigEndian.Uint64(r[8:16])
@@ -31,6 +78,9 @@ func (r request) handle() uint64 {
 func (r request) offset() uint64 {
 	return binary.BigEndian.Uint64(r[16:24])
 }
-func (r request) len() uint32 {
-	return binary.BigEndian.Uint32(r[24:28])
+func (r request) len() uint64 {
+	if len(r) == extendedRequestSize {
+		return binary.BigEndian.Uint64(r[24:32])
+	}
+	return uint64(binary.BigEndian.Uint32(r[24:28]))
 }
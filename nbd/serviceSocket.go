@@ -2,7 +2,7 @@ package nbd
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -10,46 +10,127 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/plockc/disk8s/nbd/internal/metrics"
 	"github.com/plockc/disk8s/nbd/internal/store"
 )
 
-func greeting(diskSize uint64) []byte {
-	greeting := make([]byte, 152)
-	copy(greeting[0:8], []byte("NBDMAGIC"))
-	binary.BigEndian.PutUint64(greeting[8:16], nbd_CLISERV_MAGIC)
-	binary.BigEndian.PutUint64(greeting[16:24], diskSize)
-	binary.BigEndian.PutUint32(greeting[24:28], 0)
-	return greeting
-}
-
 type serviceSocket struct {
 	io.ReadWriter
 	store.Storage
+	// export is the name of the export, for the metrics
+	export string
+	// size of the export, requests are checked against it before reaching storage
+	size uint64
+	// flags advertised for the export, commands they leave out are refused
+	flags uint16
+	// blockSizes the client agreed to during negotiation, if any, clients that did not
+	// agree to them may send reads and writes of up to 32MiB
+	blockSizes store.BlockSizes
+	// structuredReplies are used for reads when the client negotiated them
+	structuredReplies bool
+	// extendedHeaders carry 64 bit lengths, and every reply is then a chunk
+	extendedHeaders bool
+	// baseAllocation is set when the client selected the meta context for block status
+	baseAllocation bool
+	// drainTimeout bounds how long requests in flight have to finish on shutdown
+	drainTimeout time.Duration
+}
+
+// defaultDrainTimeout leaves time to finish within the default termination grace period
+// of a pod
+const defaultDrainTimeout = 20 * time.Second
+
+// ServerOptions configure how a server negotiates with its clients
+type ServerOptions struct {
+	// TLS enables NBD_OPT_STARTTLS when set
+	TLS *tls.Config
+	// TLSRequired refuses to serve exports to clients that have not started TLS
+	TLSRequired bool
+	// DrainTimeout is how long requests in flight have to finish after the server is told
+	// to shut down, before they are cancelled, 0 is 20s
+	DrainTimeout time.Duration
+	// MaxConnections bounds the clients served at once, more wait to be accepted until
+	// one disconnects, 0 is 64
+	MaxConnections int
 }
 
-func NewDomainSocketServer(ctx context.Context, storage store.Storage, domainSockets <-chan uintptr) error {
+// defaultMaxConnections with the bytes in flight of each keeps the memory of a server
+// to a few GiB
+const defaultMaxConnections = 64
+
+// NewDomainSocketServer serves the export to the kernel over the domain sockets, only the
+// DrainTimeout of the options applies as there is no negotiation
+func NewDomainSocketServer(ctx context.Context, export *Export, domainSockets <-chan uintptr, opts ServerOptions) error {
 	fmt.Println("server has been provided a domain socket")
+	size, err := export.Storage.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to determine size of storage: %w", err)
+	}
 	var lastError error
 	for domainSocketDescriptor := range domainSockets {
-		service := serviceSocket{
-			ReadWriter: os.NewFile(domainSocketDescriptor, "unix"),
-			Storage:    storage,
+		service := &serviceSocket{
+			ReadWriter:   os.NewFile(domainSocketDescriptor, "unix"),
+			Storage:      export.Storage,
+			export:       export.Name,
+			size:         size,
+			flags:        exportFlags(export),
+			drainTimeout: opts.DrainTimeout,
 		}
+		closed := observeConnection(export.Name)
 		lastError = service.server(ctx)
+		closed()
 	}
 	return lastError
 }
 
-func NewTCPSocketServer(ctx context.Context, store store.Storage, port int) error {
+// NewTCPSocketServer serves the exports to clients connecting on the port
+func NewTCPSocketServer(ctx context.Context, exports *Exports, port int, opts ServerOptions) error {
 	// listen for connections
 	server, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		return err
 	}
 	fmt.Println("Listening port", port)
+	return serve(ctx, server, exports, opts)
+}
+
+// NewUnixSocketServer serves the exports to clients connecting to the socket at path, for
+// clients on the same host such as qemu with nbd+unix:// or sidecar containers
+func NewUnixSocketServer(ctx context.Context, exports *Exports, path string, opts ServerOptions) error {
+	// a socket left behind by a server that did not exit cleanly would fail the listen,
+	// anything else at the path is not ours to remove
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("refusing to replace %s, it is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	server, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Listening on socket", path)
+	// closing the listener removes the socket file
+	return serve(ctx, server, exports, opts)
+}
+
+// serve runs the listener until the context is done, each connection is served
+// concurrently, the exports are left for the caller to release once every server
+// using them has exited
+func serve(ctx context.Context, server net.Listener, exports *Exports, opts ServerOptions) error {
 	defer server.Close()
 
+	// connections are cancelled before waiting on them, so they do not hold up the exit
+	connections := sync.WaitGroup{}
+	defer connections.Wait()
+
 	// handle external shutdown or internal shutdown
 	listenCtx, listenCancel := context.WithCancel(ctx)
 	defer listenCancel()
@@ -59,7 +140,20 @@ func NewTCPSocketServer(ctx context.Context, store store.Storage, port int) erro
 		server.Close()
 	}()
 
+	// a connection holds a slot until its handler exits, clients beyond the limit are
+	// left in the listen backlog
+	maxConnections := opts.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = defaultMaxConnections
+	}
+	slots := make(chan struct{}, maxConnections)
+
 	for {
+		select {
+		case slots <- struct{}{}:
+		case <-listenCtx.Done():
+			return nil
+		}
 		conn, err := server.Accept()
 		if err != nil {
 			// TODO: fix
@@ -70,95 +164,414 @@ func NewTCPSocketServer(ctx context.Context, store store.Storage, port int) erro
 		}
 
 		connCtx, connCancel := context.WithCancel(listenCtx)
-		// pass in the connCtx and connCancel to avoid race with next loop iter
-		go func(c net.Conn, cancel func()) {
-			select {
-			case <-connCtx.Done():
-				fmt.Println("closing server connection")
-			case <-listenCtx.Done():
-				fmt.Println("closing server connection because listener closed")
-				cancel()
+		// pass in the conn, connCtx and connCancel to avoid race with next loop iter
+		go func(c net.Conn, ctx context.Context) {
+			<-ctx.Done()
+			if listenCtx.Err() != nil {
+				// stop reading requests, the handler still replies to those in flight
+				// before it closes the connection
+				fmt.Println("draining server connection because listener closed")
+				_ = c.SetReadDeadline(time.Now())
 			}
-			conn.Close()
-		}(conn, connCancel)
+		}(conn, connCtx)
 
-		// want to make sure the connection is cancelled, so make inline func with defer close
-		func() {
-			defer connCancel()
+		// every connection gets its own goroutine so clients do not wait on each other,
+		// the connection is cancelled and closed when its handler exits
+		connections.Add(1)
+		go func(c net.Conn, ctx context.Context, cancel func()) {
+			defer connections.Done()
+			defer func() { <-slots }()
+			defer c.Close()
+			defer cancel()
+			serveConnection(ctx, c, exports, opts)
+			fmt.Println("closing server connection")
+		}(conn, connCtx, connCancel)
+	}
+}
 
-			fmt.Println("connection accepted, sending greeting")
-			size, err := store.Size(connCtx)
-			if err != nil {
-				fmt.Println("Failed to determine size of storage, cannot write greeting to client during negotiation, error:", err)
-				return
-			}
-			greet := greeting(size)
-			if n, err := conn.Write(greet); err != nil || n != 152 {
-				fmt.Println("Failed to write greeting to client during negotiation, wrote", n, "of", len(greet), "bytes and error:", err)
-				return
-			} else {
-				if err := (serviceSocket{conn, store}).server(connCtx); err != nil {
-					fmt.Println("Server connection exited with ERROR:", err)
-				} else {
-					fmt.Println("Server handler exited with no error")
-				}
-			}
-		}()
+// serveConnection negotiates with a client and then serves it the export it chose
+func serveConnection(ctx context.Context, conn net.Conn, exports *Exports, opts ServerOptions) {
+	fmt.Println("connection accepted from", conn.RemoteAddr(), "negotiating")
+	ss, err := negotiate(ctx, conn, exports, opts)
+	if err != nil {
+		if errors.Is(err, errAbort) {
+			fmt.Println("Client aborted during negotiation")
+		} else {
+			fmt.Println("Failed to negotiate with client, error:", err)
+		}
+		return
+	}
+	ss.drainTimeout = opts.DrainTimeout
+	defer observeConnection(ss.export)()
+	if err := ss.server(ctx); err != nil {
+		fmt.Println("Server connection exited with ERROR:", err)
+	} else {
+		fmt.Println("Server handler exited with no error")
+	}
+}
+
+// maxInFlight bounds how many requests are dispatched to storage at once on a connection
+const maxInFlight = 16
+
+// maxBytesInFlight bounds the memory held for the data of reads and writes on a connection
+// until their replies are sent, it fits the largest payload so every request can proceed
+const maxBytesInFlight = 2 * maxPayload
+
+// pending is a request read off the socket, along with the data of a write
+type pending struct {
+	req  request
+	data []byte
+	// cost is what the request holds of the bytes in flight until its reply is sent
+	cost uint64
+}
+
+// response is written back to the client for a request, either a simple reply and the
+// data of a read, or the chunks of a structured reply
+type response [][]byte
+
+// outgoing is a response on its way to the writer, which returns its cost once sent
+type outgoing struct {
+	resp response
+	cost uint64
+}
+
+// byteBudget hands out bytes to requests, blocking once they are all taken
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	free uint64
+}
+
+func newByteBudget(size uint64) *byteBudget {
+	b := &byteBudget{free: size}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.free < n {
+		b.cond.Wait()
 	}
+	b.free -= n
 }
 
-func (ss serviceSocket) server(ctx context.Context) error {
+func (b *byteBudget) release(n uint64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.free += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// server reads requests and hands them to a pool of workers so several storage operations
+// can be in flight at once, the replies go back out of order and are matched by handle,
+// when the context is done the requests in flight get until the drain timeout to finish
+func (ss *serviceSocket) server(ctx context.Context) error {
 	fmt.Println("starting server")
+
+	// storage operations outlive the context so they are not cut off when shutting down
+	opCtx, opCancel := context.WithCancel(context.Background())
+	defer opCancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-opCtx.Done():
+			return
+		}
+		drainTimeout := ss.drainTimeout
+		if drainTimeout == 0 {
+			drainTimeout = defaultDrainTimeout
+		}
+		timer := time.NewTimer(drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			fmt.Println("requests in flight did not finish within", drainTimeout, ", cancelling them")
+			opCancel()
+		case <-opCtx.Done():
+		}
+	}()
+
+	work := make(chan pending)
+	responses := make(chan outgoing, maxInFlight)
+	writeErr := make(chan error, 1)
+	budget := newByteBudget(maxBytesInFlight)
+
+	workers := sync.WaitGroup{}
+	for i := 0; i < maxInFlight; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for p := range work {
+				done := ss.observe(p.req)
+				resp := ss.handle(opCtx, p.req, p.data)
+				done()
+				responses <- outgoing{resp, p.cost}
+			}
+		}()
+	}
+
+	// replies are written by a single goroutine so they do not interleave on the socket
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		failed := false
+		for out := range responses {
+			// keep draining after a failure so the workers and the reader can finish
+			if !failed && out.resp != nil {
+				if err := ss.writeResponse(out.resp); err != nil {
+					failed = true
+					writeErr <- err
+				}
+			}
+			budget.release(out.cost)
+		}
+	}()
+
+	// on every exit, finish the requests in flight so the storage is not used after we return
+	drained := false
+	defer func() {
+		close(work)
+		workers.Wait()
+		// what was acknowledged to the client is made durable before hanging up
+		if drained && ss.flags&nbd_FLAG_READ_ONLY == 0 {
+			if err := ss.Storage.Flush(opCtx); err != nil {
+				fmt.Println("failed to flush storage while draining:", err)
+			}
+		}
+		close(responses)
+		<-writerDone
+	}()
+
+	size, magic := requestSize, uint32(nbd_REQUEST_MAGIC)
+	if ss.extendedHeaders {
+		size, magic = extendedRequestSize, nbd_EXTENDED_REQUEST_MAGIC
+	}
 	for {
-		req := request(make([]byte, 28))
-		if n, err := io.ReadFull(ss, req); err != nil || n != 28 {
+		req := request(make([]byte, size))
+		if n, err := io.ReadFull(ss, req); err != nil || n != size {
 			// if no error but not bytes, the connection was closed, exit the server
 			if errors.Is(err, io.EOF) && n == 0 {
 				return nil
 			}
+			// reading was stopped for the shutdown, a request cut off part way through is
+			// left for the client to send again
+			if ctx.Err() != nil {
+				fmt.Println("draining requests in flight")
+				drained = true
+				return nil
+			}
 			return fmt.Errorf("nbd server could not read request, got %d bytes: %w", n, err)
 		}
-		if req.magic() != nbd_REQUEST_MAGIC {
+		if req.magic() != magic {
+			// without the magic there is no telling where the next request starts
 			return fmt.Errorf("Fatal error: received packet with wrong Magic number")
 		}
-		var rep *reply
-		var replyData []byte
+		p := pending{req: req}
 		switch req.command() {
 		case nbd_CMD_DISC:
 			fmt.Println("Server is disconnecting by request of remote kernel")
-			ss.Storage.Release()
+			drained = true
 			return nil
 		case nbd_CMD_READ:
-			rep = newReply(req.handle())
-			replyData = make([]byte, req.len())
-			if err := ss.Storage.ReadAt(ctx, replyData, req.offset()); err != nil {
-				log.Println("Error:", err)
-				// Reply with an EPERM
-				rep.err(1)
-				replyData = nil
-				break
+			// the buffer of a read is only made once the read is accepted
+			if _, refused := ss.validate(req); refused == nil {
+				p.cost = req.len()
+				budget.acquire(p.cost)
 			}
 		case nbd_CMD_WRITE:
-			rep = newReply(req.handle())
-			respData := make([]byte, req.len())
-			if _, err := io.ReadFull(ss, respData); err != nil {
-				return fmt.Errorf("could not read request data for a remote device write: %w", err)
+			if req.len() > maxPayload {
+				// skipping that much data is no better than hanging up
+				return fmt.Errorf("remote device write of %d bytes is over the limit of %d", req.len(), maxPayload)
 			}
-			if err := ss.Storage.WriteAt(ctx, respData, req.offset()); err != nil {
-				log.Println("error for data written to device when writing to remote device:", err)
-				rep.err(1)
-			}
-		default:
-			fmt.Println("UNKNOWN COMMAND", req.command())
-			continue
-		}
-		if rep != nil {
-			if n, err := ss.Write(*rep); err != nil || n != len(*rep) {
-				return fmt.Errorf("failed to send reply to /dev/nbd*: %w", err)
+			// the data follows the request, so it has to be read before the next request,
+			// a write that is going to be refused is skipped rather than held in memory
+			var err error
+			if _, refused := ss.validate(req); refused != nil {
+				_, err = io.CopyN(io.Discard, ss, int64(req.len()))
+			} else {
+				p.cost = req.len()
+				budget.acquire(p.cost)
+				p.data = make([]byte, req.len())
+				_, err = io.ReadFull(ss, p.data)
 			}
-			if n, err := ss.Write(replyData); err != nil || n != len(replyData) {
-				return fmt.Errorf("failed to write back data payload to /dev/nbd*: %w", err)
+			if err != nil {
+				budget.release(p.cost)
+				if ctx.Err() != nil {
+					fmt.Println("draining requests in flight")
+					drained = true
+					return nil
+				}
+				return fmt.Errorf("could not read request data for a remote device write: %w", err)
 			}
 		}
+		select {
+		case work <- p:
+		case err := <-writeErr:
+			budget.release(p.cost)
+			return err
+		}
+	}
+}
+
+// handle carries out a request against storage, returning nil if there is nothing to reply
+func (ss *serviceSocket) handle(ctx context.Context, req request, data []byte) response {
+	if code, err := ss.validate(req); err != nil {
+		log.Println("refusing request:", err)
+		return ss.errorResponse(req, code, err)
+	}
+	ss.observeBytes(req)
+	fua := req.flags()&nbd_CMD_FLAG_FUA != 0
+	switch req.command() {
+	case nbd_CMD_READ:
+		replyData := make([]byte, req.len())
+		if err := ss.Storage.ReadAt(ctx, replyData, req.offset()); err != nil {
+			log.Println("Error:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+		if ss.structuredReplies {
+			return ss.readChunks(req, replyData)
+		}
+		return response{*newReply(req.handle()), replyData}
+	case nbd_CMD_WRITE:
+		if err := ss.Storage.WriteAt(ctx, data, req.offset(), fua); err != nil {
+			log.Println("error for data written to device when writing to remote device:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+	case nbd_CMD_TRIM:
+		if err := ss.Storage.Trim(ctx, req.offset(), req.len()); err != nil {
+			log.Println("error trimming remote device:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+		if fua {
+			return ss.flushForFUA(ctx, req)
+		}
+	case nbd_CMD_WRITE_ZEROES:
+		noHole := req.flags()&nbd_CMD_FLAG_NO_HOLE != 0
+		if err := ss.Storage.WriteZeroes(ctx, req.offset(), req.len(), noHole); err != nil {
+			log.Println("error writing zeroes to remote device:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+		if fua {
+			return ss.flushForFUA(ctx, req)
+		}
+	case nbd_CMD_BLOCK_STATUS:
+		if !ss.baseAllocation {
+			err := fmt.Errorf("block status requested without selecting a meta context")
+			log.Println(err)
+			return ss.errorResponse(req, nbd_EINVAL, err)
+		}
+		extents, err := ss.Storage.Extents(ctx, req.offset(), req.len())
+		if err != nil {
+			log.Println("error finding extents of remote device:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+		reqOne := req.flags()&nbd_CMD_FLAG_REQ_ONE != 0
+		return ss.blockStatusChunk(req, trimExtents(extents, req.len(), reqOne))
+	case nbd_CMD_FLUSH:
+		if err := ss.Storage.Flush(ctx); err != nil {
+			log.Println("error flushing remote device:", err)
+			return ss.errorResponse(req, errno(err), err)
+		}
+	}
+	return ss.doneResponse(req)
+}
+
+// validate checks the command, flags and range of a request, returning the error to
+// reply with when the request cannot be carried out
+func (ss *serviceSocket) validate(req request) (uint32, error) {
+	allowed, ok := validFlags[req.command()]
+	if !ok {
+		return nbd_EINVAL, fmt.Errorf("unknown command %d", req.command())
+	}
+	// fua is valid for every command, though it only matters for those that write
+	if unknown := req.flags() &^ (allowed | nbd_CMD_FLAG_FUA); unknown != 0 {
+		return nbd_EINVAL, fmt.Errorf("unsupported flags %#x for command %d", unknown, req.command())
+	}
+	switch req.command() {
+	case nbd_CMD_WRITE, nbd_CMD_TRIM, nbd_CMD_WRITE_ZEROES:
+		if ss.flags&nbd_FLAG_READ_ONLY != 0 {
+			return nbd_EPERM, fmt.Errorf("export is read-only, refusing command %d", req.command())
+		}
+	}
+	if advertised, ok := commandFlag[req.command()]; ok && ss.flags&advertised == 0 {
+		return nbd_EINVAL, fmt.Errorf("command %d was not advertised for the export", req.command())
+	}
+	switch req.command() {
+	case nbd_CMD_FLUSH:
+		return 0, nil
+	case nbd_CMD_READ:
+		if req.len() > maxPayload {
+			return nbd_EINVAL, fmt.Errorf("read of %d bytes is over the limit of %d", req.len(), maxPayload)
+		}
+	case nbd_CMD_TRIM, nbd_CMD_WRITE_ZEROES, nbd_CMD_BLOCK_STATUS:
+		// there is nothing to do for an empty range, and block status must reply with
+		// at least one extent
+		if req.len() == 0 {
+			return nbd_EINVAL, fmt.Errorf("command %d with a length of 0", req.command())
+		}
+	}
+	if minimum := uint64(ss.blockSizes.Minimum); minimum > 1 && (req.offset()%minimum != 0 || req.len()%minimum != 0) {
+		return nbd_EINVAL, fmt.Errorf("%d bytes at %d is not aligned to the block size %d", req.len(), req.offset(), minimum)
+	}
+	switch req.command() {
+	case nbd_CMD_READ, nbd_CMD_WRITE:
+		if maximum := uint64(ss.blockSizes.Maximum); maximum != 0 && req.len() > maximum {
+			return nbd_EINVAL, fmt.Errorf("%d bytes is over the maximum block size %d", req.len(), maximum)
+		}
+	}
+	end := req.offset() + req.len()
+	if end < req.offset() || end > ss.size {
+		err := fmt.Errorf("%d bytes at %d is past the export size %d", req.len(), req.offset(), ss.size)
+		switch req.command() {
+		case nbd_CMD_WRITE, nbd_CMD_WRITE_ZEROES:
+			return nbd_ENOSPC, err
+		}
+		return nbd_EINVAL, err
+	}
+	return 0, nil
+}
+
+// errorResponse replies with an error, as an error chunk once structured replies are
+// negotiated so the message reaches the client
+func (ss *serviceSocket) errorResponse(req request, code uint32, err error) response {
+	metrics.RequestErrors.WithLabelValues(ss.export, commandName(req.command()), errnoName(code)).Inc()
+	if ss.structuredReplies {
+		return response{ss.errorChunk(req, code, err.Error())}
+	}
+	rep := newReply(req.handle())
+	rep.err(code)
+	return response{*rep}
+}
+
+// doneResponse replies to a request that succeeded without any data to send back,
+// extended headers have no simple reply so it is an empty chunk
+func (ss *serviceSocket) doneResponse(req request) response {
+	if ss.extendedHeaders {
+		return response{ss.chunkHeader(req, nbd_REPLY_FLAG_DONE, nbd_REPLY_TYPE_NONE, 0)}
+	}
+	return response{*newReply(req.handle())}
+}
+
+// flushForFUA makes a trim or write zeroes durable before replying, writes instead
+// pass fua through to storage
+func (ss *serviceSocket) flushForFUA(ctx context.Context, req request) response {
+	if err := ss.Storage.Flush(ctx); err != nil {
+		log.Println("error flushing remote device for fua:", err)
+		return ss.errorResponse(req, errno(err), err)
+	}
+	return ss.doneResponse(req)
+}
+
+func (ss *serviceSocket) writeResponse(resp response) error {
+	for _, part := range resp {
+		if n, err := ss.Write(part); err != nil || n != len(part) {
+			return fmt.Errorf("failed to send reply to /dev/nbd*: %w", err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,328 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+func TestValidateMaximum(t *testing.T) {
+	negotiated := &serviceSocket{size: 64 << 20, flags: nbd_FLAG_HAS_FLAGS, blockSizes: store.BlockSizes{Minimum: 1, Preferred: 4096, Maximum: 2 << 20}}
+	// clients that did not negotiate block sizes, like the kernel, are only held to the
+	// 32MiB every server should take
+	plain := &serviceSocket{size: 64 << 20, flags: nbd_FLAG_HAS_FLAGS}
+	tests := []struct {
+		ss   *serviceSocket
+		req  request
+		want uint32
+	}{
+		{negotiated, request(clientRequest(nbd_CMD_READ, 0, 1, 0, 2<<20)), 0},
+		{negotiated, request(clientRequest(nbd_CMD_READ, 0, 2, 0, 2<<20+512)), nbd_EINVAL},
+		{negotiated, request(clientRequest(nbd_CMD_WRITE, 0, 3, 0, 2<<20)), 0},
+		{negotiated, request(clientRequest(nbd_CMD_WRITE, 0, 4, 0, 32<<20)), nbd_EINVAL},
+		{plain, request(clientRequest(nbd_CMD_READ, 0, 5, 0, 4<<20)), 0},
+		{plain, request(clientRequest(nbd_CMD_READ, 0, 6, 0, 32<<20)), 0},
+		{plain, request(clientRequest(nbd_CMD_READ, 0, 7, 0, 32<<20+512)), nbd_EINVAL},
+		{plain, request(clientRequest(nbd_CMD_WRITE, 0, 8, 0, 32<<20)), 0},
+	}
+	for _, test := range tests {
+		if code, _ := test.ss.validate(test.req); code != test.want {
+			t.Errorf("command %d of %d bytes with maximum %d got error %d, expected %d", test.req.command(), test.req.len(), test.ss.blockSizes.Maximum, code, test.want)
+		}
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	tests := []struct {
+		queue   QueueOptions
+		maximum uint32
+		want    uint32
+	}{
+		{QueueOptions{}, 0, 0},
+		{QueueOptions{}, 2 << 20, 2048},
+		{QueueOptions{MaxSectorsKB: 128}, 2 << 20, 128},
+		{QueueOptions{MaxSectorsKB: 32768}, 2 << 20, 2048},
+		{QueueOptions{MaxSectorsKB: 128}, 1024, 128},
+	}
+	for _, test := range tests {
+		if got := test.queue.limit(test.maximum).MaxSectorsKB; got != test.want {
+			t.Errorf("max sectors %dKB limited by %d is %dKB, expected %d", test.queue.MaxSectorsKB, test.maximum, got, test.want)
+		}
+	}
+}
+
+func TestRefusedWriteSkipped(t *testing.T) {
+	storage := &fuzzStorage{data: make([]byte, fuzzSize)}
+	copy(storage.data, "kept")
+	// the write is refused as the export is read-only, its data is skipped so the read
+	// that follows is still found
+	payload := bytes.Repeat([]byte{0xff}, 1<<20)
+	in := append(clientRequest(nbd_CMD_WRITE, 0, 1, 0, uint32(len(payload))), payload...)
+	in = append(in, clientRequest(nbd_CMD_READ, 0, 2, 0, 4)...)
+	in = append(in, clientRequest(nbd_CMD_DISC, 0, 3, 0, 0)...)
+	out := bytes.Buffer{}
+	ss := &serviceSocket{
+		ReadWriter: struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(in), &out},
+		Storage: storage,
+		size:    fuzzSize,
+		flags:   exportFlags(&Export{Storage: storage, ReadOnly: true}),
+	}
+	if err := ss.server(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	codes := map[uint64]uint32{}
+	for replies := out.Bytes(); len(replies) >= 16; {
+		handle := binary.BigEndian.Uint64(replies[8:16])
+		codes[handle] = binary.BigEndian.Uint32(replies[4:8])
+		replies = replies[16:]
+		if handle == 2 {
+			if string(replies[:4]) != "kept" {
+				t.Fatalf("read %q", replies[:4])
+			}
+			replies = replies[4:]
+		}
+	}
+	if len(codes) != 2 || codes[1] != nbd_EPERM || codes[2] != 0 {
+		t.Fatalf("replies had errors %v, expected EPERM for the write only", codes)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	b := newByteBudget(10)
+	b.acquire(6)
+	acquired := make(chan struct{})
+	go func() {
+		b.acquire(6)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more bytes than are free")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(6)
+	select {
+	case <-acquired:
+	case <-time.After(10 * time.Second):
+		t.Fatal("released bytes were not handed out")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	exports := NewExports()
+	if err := exports.Add("disk", store.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+	defer exports.Release()
+	addr := testServer(t, exports, ServerOptions{MaxConnections: 1})
+
+	dial := func(timeout time.Duration) (*Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return Dial(ctx, "tcp", addr, DialOptions{ExportName: "disk"})
+	}
+	first, err := dial(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second client is left waiting to be accepted, so it never gets a greeting
+	if second, err := dial(200 * time.Millisecond); err == nil {
+		second.Close()
+		t.Fatal("server accepted a connection over the limit")
+	}
+	first.Close()
+	second, err := dial(10 * time.Second)
+	if err != nil {
+		t.Fatalf("connection after the first closed got %v", err)
+	}
+	second.Close()
+}
+
+func TestUnixSocketServer(t *testing.T) {
+	exports := NewExports()
+	if err := exports.Add("disk", store.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+	defer exports.Release()
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+	// a socket left behind by an earlier server is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- NewUnixSocketServer(ctx, exports, path, ServerOptions{}) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer dialCancel()
+	var c *Conn
+	for {
+		if c, err = DialURI(dialCtx, "nbd+unix:///disk?socket="+path, DialOptions{}); err == nil {
+			break
+		}
+		if dialCtx.Err() != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer c.Close()
+	if err := c.WriteAt(dialCtx, []byte("unix"), 0, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixSocketServerKeepsFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "important")
+	if err := os.WriteFile(path, []byte("not a socket"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := NewUnixSocketServer(context.Background(), NewExports(), path, ServerOptions{})
+	if err == nil {
+		t.Fatal("server started in place of a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "not a socket" {
+		t.Fatalf("file was changed, read %q with error %v", data, err)
+	}
+}
+
+// blockingStorage holds writes until they are released or cancelled
+type blockingStorage struct {
+	*fuzzStorage
+	started chan struct{}
+	release chan struct{}
+	flushed chan struct{}
+}
+
+func newBlockingStorage() *blockingStorage {
+	return &blockingStorage{
+		fuzzStorage: &fuzzStorage{data: make([]byte, fuzzSize)},
+		started:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+		flushed:     make(chan struct{}, 1),
+	}
+}
+
+func (s *blockingStorage) WriteAt(ctx context.Context, p []byte, off uint64, fua bool) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return s.fuzzStorage.WriteAt(ctx, p, off, fua)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *blockingStorage) Flush(context.Context) error {
+	select {
+	case s.flushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// drainTest starts a write that the storage holds, then shuts the server down
+func drainTest(t *testing.T, storage *blockingStorage, drainTimeout time.Duration) chan error {
+	t.Helper()
+	exports := NewExports()
+	if err := exports.Add("disk", storage); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, listener, exports, ServerOptions{DrainTimeout: drainTimeout}) }()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer dialCancel()
+	c, err := Dial(dialCtx, "tcp", listener.Addr().String(), DialOptions{ExportName: "disk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	written := make(chan error, 1)
+	go func() { written <- c.WriteAt(context.Background(), []byte("drained"), 0, false) }()
+	select {
+	case <-storage.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("write did not reach storage")
+	}
+	cancel()
+	return written
+}
+
+func TestServerDrain(t *testing.T) {
+	storage := newBlockingStorage()
+	written := drainTest(t, storage, 10*time.Second)
+	select {
+	case err := <-written:
+		t.Fatalf("write finished while storage still held it: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the write in flight is carried out and replied to before the connection closes
+	close(storage.release)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("write in flight during shutdown got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write in flight was not replied to")
+	}
+	select {
+	case <-storage.flushed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("storage was not flushed while draining")
+	}
+	if string(storage.data[:7]) != "drained" {
+		t.Fatalf("storage has %q", storage.data[:7])
+	}
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	storage := newBlockingStorage()
+	start := time.Now()
+	written := drainTest(t, storage, 100*time.Millisecond)
+
+	// storage never lets go of the write, so it is cancelled once the drain timeout passes
+	select {
+	case err := <-written:
+		if !errors.Is(err, syscall.ESHUTDOWN) {
+			t.Fatalf("write cancelled by the drain timeout got %v, expected ESHUTDOWN", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write held by storage was not cancelled")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("write was cancelled after %v, before the drain timeout", elapsed)
+	}
+}
@@ -0,0 +1,253 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultDeadConnTimeout is how long the kernel stalls requests while reconnecting
+	defaultDeadConnTimeout = 2 * time.Minute
+	minReconnectBackoff    = time.Second
+	maxReconnectBackoff    = 30 * time.Second
+)
+
+// kernelConn is a negotiated connection ready to hand to the kernel
+type kernelConn struct {
+	socket uintptr
+	config DeviceConfig
+	// maxRequest is the largest read or write the export takes, 0 when it did not say
+	maxRequest uint32
+	// close releases this process's side of the connection once the kernel is done with it
+	close func()
+}
+
+// supervise has the kernel serve the device over conn until the context is done, when the
+// kernel reports the connection dead a new one from redial replaces it, and requests stall
+// rather than fail for the dead connection timeout, a nil redial gives up instead.  With
+// redial the kernel is given opts.Connections connections if the export allows it.
+func supervise(ctx context.Context, deviceName string, conn *kernelConn, redial func() (*kernelConn, error), opts ClientOptions) error {
+	conns := []*kernelConn{conn}
+	defer func() {
+		for _, c := range conns {
+			c.close()
+		}
+	}()
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	index, err := deviceIndex(deviceName)
+	if err != nil {
+		return err
+	}
+	config := opts.deviceConfig(conn.config)
+	if redial == nil {
+		config.DeadConnTimeout = 0
+	} else if config.DeadConnTimeout == 0 {
+		config.DeadConnTimeout = defaultDeadConnTimeout
+	}
+
+	// subscribe before connecting so a connection dying right away is not missed
+	events, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if errors.Is(err, errNoNetlink) {
+		fmt.Println("falling back to ioctl to configure the device, without reconnects or multiple connections:", err)
+		if deviceName == "" {
+			device, err := FreeDevice()
+			if err != nil {
+				return err
+			}
+			deviceName = device.Path()
+		}
+		return Client(ctx, deviceName, config, opts, conn.socket)
+	}
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	if err := events.subscribe(nbd_GENL_MCAST_GROUP_NAME, time.Second); err != nil {
+		return err
+	}
+	// the status is checked every second, over a socket of its own as replies on the
+	// subscribed one would be mixed in with the notifications
+	control, err := dialGenetlink(nbd_GENL_FAMILY_NAME)
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	connections := 1
+	if opts.Connections > 1 && redial != nil {
+		if conn.config.Flags&nbd_FLAG_CAN_MULTI_CONN != 0 {
+			connections = opts.Connections
+		} else {
+			fmt.Println("export does not allow multiple connections, using one")
+		}
+	}
+	for len(conns) < connections {
+		next, err := redial()
+		if err != nil {
+			return fmt.Errorf("failed to open connection %d of %d: %w", len(conns)+1, connections, err)
+		}
+		conns = append(conns, next)
+	}
+
+	device, err := ConnectDevice(index, config, sockets(conns)...)
+	if err != nil {
+		return err
+	}
+	fmt.Println("kernel is serving", device.Path(), "over", len(conns), "connections")
+	opts.Queue.apply(device)
+	defer func() {
+		if err := device.Disconnect(); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Client Device has been disconnected")
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			fmt.Println("begin gracefully shutting down device client...")
+			drainDevice(device, opts)
+			return nil
+		}
+		notifications, err := events.notifications()
+		if err != nil {
+			return fmt.Errorf("failed to receive nbd notifications: %w", err)
+		}
+		if len(notifications) == 0 {
+			// the device does not need this process to stay connected, so check in case
+			// something else disconnects it
+			status, err := device.status(control)
+			if err != nil {
+				fmt.Println("failed to check on the device:", err)
+			} else if !status.Connected {
+				fmt.Println(device.Path(), "was disconnected")
+				return nil
+			}
+			continue
+		}
+		if !linkDead(notifications, device) {
+			continue
+		}
+
+		// the kernel shuts down the sockets it gave up on, those are the ones to replace
+		live, dead := []*kernelConn{}, 0
+		for _, c := range conns {
+			if len(conns) == 1 || c.hungUp() {
+				c.close()
+				dead++
+			} else {
+				live = append(live, c)
+			}
+		}
+		conns = live
+		if dead == 0 {
+			// the kernel refuses new sockets while none is dead
+			fmt.Println("none of the connections of", device.Path(), "look dead")
+			continue
+		}
+		fmt.Println(dead, "connections of", device.Path(), "are dead")
+		if redial == nil {
+			return errors.New("lost the connection of " + device.Path())
+		}
+		next, err := reconnect(ctx, device, redial, config, dead)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		conns = append(conns, next...)
+		// the kernel keeps the size it was connected with
+		if next[0].config.Size != conn.config.Size {
+			fmt.Printf("export is now %d bytes but %s stays at %d\n", next[0].config.Size, device.Path(), conn.config.Size)
+		}
+		fmt.Println("reconnected", device.Path())
+	}
+}
+
+// sockets are what the kernel is given of the connections
+func sockets(conns []*kernelConn) []uintptr {
+	s := make([]uintptr, len(conns))
+	for i, c := range conns {
+		s[i] = c.socket
+	}
+	return s
+}
+
+// hungUp is whether the socket was shut down, which the kernel does to a connection it
+// declares dead
+func (c *kernelConn) hungUp() bool {
+	fds := []unix.PollFd{{Fd: int32(c.socket), Events: unix.POLLRDHUP}}
+	if _, err := unix.Poll(fds, 0); err != nil {
+		return false
+	}
+	return fds[0].Revents&(unix.POLLHUP|unix.POLLRDHUP|unix.POLLERR|unix.POLLNVAL) != 0
+}
+
+// drainDevice writes back the device before it is disconnected
+func drainDevice(device Device, opts ClientOptions) {
+	f, err := os.OpenFile(device.Path(), os.O_RDWR, 0600)
+	if err != nil {
+		fmt.Println("cannot write back the device before disconnecting:", err)
+		return
+	}
+	defer f.Close()
+	opts.drain(device, f)
+}
+
+// linkDead is whether the kernel reported a dead connection for the device
+func linkDead(notifications []notification, device Device) bool {
+	for _, n := range notifications {
+		if netlinkCommand(n.cmd) != nbd_NL_CMD_LINK_DEAD {
+			continue
+		}
+		for _, a := range parseAttributes(n.attrs) {
+			if netlinkAttr(a.typ) == nbd_ATTR_INDEX && len(a.data) >= 4 && nativeEndian.Uint32(a.data) == device.Index {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reconnect redials n connections with backoff until the kernel takes them in place of
+// the dead ones
+func reconnect(ctx context.Context, device Device, redial func() (*kernelConn, error), config DeviceConfig, n int) ([]*kernelConn, error) {
+	backoff := minReconnectBackoff
+	for {
+		conns := []*kernelConn{}
+		var err error
+		for len(conns) < n && err == nil {
+			var conn *kernelConn
+			if conn, err = redial(); err == nil {
+				conns = append(conns, conn)
+			}
+		}
+		if err == nil {
+			err = device.Reconfigure(config, sockets(conns)...)
+			if err == nil {
+				return conns, nil
+			}
+		}
+		for _, conn := range conns {
+			conn.close()
+		}
+		fmt.Println("failed to reconnect", device.Path(), "retrying in", backoff, ":", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
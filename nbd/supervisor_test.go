@@ -0,0 +1,26 @@
+package nbd
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestHungUp(t *testing.T) {
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pair[0])
+	defer syscall.Close(pair[1])
+	conn := &kernelConn{socket: uintptr(pair[0])}
+	if conn.hungUp() {
+		t.Fatal("connected socket looks hung up")
+	}
+	// the kernel shuts down both directions of a connection it declares dead
+	if err := syscall.Shutdown(pair[0], syscall.SHUT_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.hungUp() {
+		t.Fatal("shut down socket does not look hung up")
+	}
+}
@@ -0,0 +1,116 @@
+package nbd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plockc/disk8s/nbd/internal/store"
+)
+
+// testCert writes a certificate for localhost with the usage, signed by the parent or by
+// itself when parent is nil, and returns the files along with what is needed to sign others
+func testCert(t *testing.T, name string, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert, key
+}
+
+func TestClientCertificates(t *testing.T) {
+	caFile, _, ca, caKey := testCert(t, "ca", x509.ExtKeyUsageAny, nil, nil)
+	serverCert, serverKey, _, _ := testCert(t, "server", x509.ExtKeyUsageServerAuth, ca, caKey)
+	clientCert, clientKey, _, _ := testCert(t, "client", x509.ExtKeyUsageClientAuth, ca, caKey)
+
+	serverTLS, err := ServerTLSConfig(serverCert, serverKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports := NewExports()
+	if err := exports.Add("disk", store.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+	defer exports.Release()
+	addr := testServer(t, exports, ServerOptions{TLS: serverTLS, TLSRequired: true})
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+		ok                bool
+	}{
+		{"client certificate", clientCert, clientKey, true},
+		{"no certificate", "", "", false},
+		// the server certificate is not for client auth, so it cannot stand in for one
+		{"server certificate", serverCert, serverKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientTLS, err := ClientTLSConfig(caFile, test.certFile, test.keyFile, "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c, err := Dial(ctx, "tcp", addr, DialOptions{ExportName: "disk", TLS: clientTLS})
+			if !test.ok {
+				if err == nil {
+					c.Close()
+					t.Fatal("server accepted the client")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.WriteAt(ctx, []byte("mutual"), 0, false); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package nbd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPort is the port registered for NBD
+const defaultPort = "10809"
+
+// Target is an export on an NBD server, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/uri.md
+type Target struct {
+	// Network is "tcp" or "unix"
+	Network string
+	// Address is host:port for tcp, and the socket path for unix
+	Address string
+	// ExportName is empty for the default export of the server
+	ExportName string
+	// TLS is required by the nbds schemes
+	TLS bool
+}
+
+// ParseURI parses URIs like nbd://host:port/export, nbds://[::1]/export for TLS,
+// and nbd+unix:///export?socket=/run/nbd.sock
+func ParseURI(uri string) (Target, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid NBD URI %q: %w", uri, err)
+	}
+	target := Target{ExportName: strings.TrimPrefix(u.Path, "/")}
+	transport := ""
+	switch u.Scheme {
+	case "nbd", "nbd+tcp", "nbd+unix":
+		transport = strings.TrimPrefix(u.Scheme, "nbd")
+	case "nbds", "nbds+tcp", "nbds+unix":
+		transport = strings.TrimPrefix(u.Scheme, "nbds")
+		target.TLS = true
+	default:
+		return Target{}, fmt.Errorf("NBD URI %q has unsupported scheme %q", uri, u.Scheme)
+	}
+	if u.User != nil {
+		return Target{}, fmt.Errorf("NBD URI %q cannot have a user", uri)
+	}
+
+	switch transport {
+	case "", "+tcp":
+		target.Network = "tcp"
+		host, port := u.Hostname(), u.Port()
+		if host == "" {
+			host = "localhost"
+		}
+		if port == "" {
+			port = defaultPort
+		}
+		target.Address = net.JoinHostPort(host, port)
+	case "+unix":
+		target.Network = "unix"
+		if u.Host != "" {
+			return Target{}, fmt.Errorf("NBD URI %q cannot have a host with a UNIX socket", uri)
+		}
+		target.Address = u.Query().Get("socket")
+		if target.Address == "" {
+			return Target{}, fmt.Errorf("NBD URI %q needs ?socket=path", uri)
+		}
+	}
+	return target, nil
+}
+
+// Host is the name to verify the TLS certificate of the server against
+func (t Target) Host() string {
+	if t.Network == "unix" {
+		return "localhost"
+	}
+	host, _, err := net.SplitHostPort(t.Address)
+	if err != nil {
+		return t.Address
+	}
+	return host
+}
+
+// String formats the target back into an NBD URI
+func (t Target) String() string {
+	scheme := "nbd"
+	if t.TLS {
+		scheme = "nbds"
+	}
+	export := (&url.URL{Path: t.ExportName}).EscapedPath()
+	if t.Network == "unix" {
+		return scheme + "+unix:///" + export + "?socket=" + url.QueryEscape(t.Address)
+	}
+	return scheme + "://" + t.Address + "/" + export
+}
@@ -0,0 +1,60 @@
+package nbd
+
+import (
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want Target
+		host string
+	}{
+		{"nbd://example.com/disk", Target{Network: "tcp", Address: "example.com:10809", ExportName: "disk"}, "example.com"},
+		{"nbd://example.com:1234/disk", Target{Network: "tcp", Address: "example.com:1234", ExportName: "disk"}, "example.com"},
+		{"nbd+tcp://example.com", Target{Network: "tcp", Address: "example.com:10809"}, "example.com"},
+		{"nbd:///", Target{Network: "tcp", Address: "localhost:10809"}, "localhost"},
+		{"nbds://example.com/disk", Target{Network: "tcp", Address: "example.com:10809", ExportName: "disk", TLS: true}, "example.com"},
+		{"nbds+tcp://example.com:1234/", Target{Network: "tcp", Address: "example.com:1234", TLS: true}, "example.com"},
+		// IPv6 addresses keep their brackets once joined with the port
+		{"nbd://[2001:db8::1]/disk", Target{Network: "tcp", Address: "[2001:db8::1]:10809", ExportName: "disk"}, "2001:db8::1"},
+		{"nbds://[::1]:1234/disk", Target{Network: "tcp", Address: "[::1]:1234", ExportName: "disk", TLS: true}, "::1"},
+		{"nbd+unix:///disk?socket=/run/nbd.sock", Target{Network: "unix", Address: "/run/nbd.sock", ExportName: "disk"}, "localhost"},
+		{"nbds+unix:///?socket=/run/nbd.sock", Target{Network: "unix", Address: "/run/nbd.sock", TLS: true}, "localhost"},
+		{"nbd://example.com/a%20disk", Target{Network: "tcp", Address: "example.com:10809", ExportName: "a disk"}, "example.com"},
+	}
+	for _, test := range tests {
+		got, err := ParseURI(test.uri)
+		if err != nil {
+			t.Errorf("ParseURI(%q) failed: %v", test.uri, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseURI(%q) = %+v, expected %+v", test.uri, got, test.want)
+		}
+		if host := got.Host(); host != test.host {
+			t.Errorf("host of %q is %q, expected %q", test.uri, host, test.host)
+		}
+		// the formatted target parses back to the same one
+		if again, err := ParseURI(got.String()); err != nil || again != got {
+			t.Errorf("%q formatted as %q parses to %+v, %v", test.uri, got.String(), again, err)
+		}
+	}
+}
+
+func TestParseURIInvalid(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com/disk",
+		"nbd+udp://example.com/disk",
+		"nbd://user@example.com/disk",
+		"nbd://[::1/disk",
+		"nbd+unix:///disk",
+		"nbd+unix://example.com/disk?socket=/run/nbd.sock",
+		"example.com/disk",
+		"://",
+	} {
+		if target, err := ParseURI(uri); err == nil {
+			t.Errorf("ParseURI(%q) = %+v, expected an error", uri, target)
+		}
+	}
+}